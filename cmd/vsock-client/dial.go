@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/mdlayher/vsock"
+)
+
+// dialer returns a function connecting to a vsock://CID:PORT,
+// unix:///PATH or tcp://HOST:PORT URI, suitable for http.Transport.Dial.
+func dialer(uri string) (func(network, addr string) (net.Conn, error), error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "vsock":
+		cid, err := strconv.ParseUint(u.Hostname(), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address %q: bad context ID", uri)
+		}
+
+		port, err := strconv.ParseUint(u.Port(), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address %q: bad port", uri)
+		}
+
+		return func(network, addr string) (net.Conn, error) {
+			return vsock.Dial(uint32(cid), uint32(port))
+		}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("Invalid address %q: missing path", uri)
+		}
+
+		return func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", u.Path)
+		}, nil
+	case "tcp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("Invalid address %q: missing port", uri)
+		}
+
+		return func(network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", u.Host)
+		}, nil
+	default:
+		return nil, fmt.Errorf("Invalid address %q: unsupported scheme %q", uri, u.Scheme)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsock-dial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unixListener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	tests := []struct {
+		name string
+		uri  string
+		err  bool
+
+		// Listener the dialer is expected to connect to
+		l net.Listener
+	}{
+		{name: "vsock", uri: "vsock://3:8443"},
+		{name: "unix", uri: "unix://" + unixListener.Addr().String(), l: unixListener},
+		{name: "tcp", uri: "tcp://" + tcpListener.Addr().String(), l: tcpListener},
+		{name: "vsock without context ID", uri: "vsock://:8443", err: true},
+		{name: "vsock with bad context ID", uri: "vsock://host:8443", err: true},
+		{name: "vsock without port", uri: "vsock://3", err: true},
+		{name: "unix without path", uri: "unix://", err: true},
+		{name: "tcp without port", uri: "tcp://127.0.0.1", err: true},
+		{name: "unsupported scheme", uri: "udp://127.0.0.1:8443", err: true},
+		{name: "invalid URI", uri: "tcp://[::1", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dial, err := dialer(test.uri)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if test.err {
+				return
+			}
+
+			if dial == nil {
+				t.Fatalf("Missing dial function")
+			}
+
+			if test.l == nil {
+				return
+			}
+
+			conn, err := dial("tcp", "vsock:8443")
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+
+			peer, err := test.l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer.Close()
+		})
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	"github.com/monstermunchkin/vsock/shared"
+)
+
+var fileCommands = map[string]func(*ProtocolLXD, []string) error{
+	"ls":    fileListCommand,
+	"mkdir": fileMkdirCommand,
+	"pull":  filePullCommand,
+	"push":  filePushCommand,
+	"rm":    fileDeleteCommand,
+}
+
+func fileCommand(d *ProtocolLXD, args []string) error {
+	usage := func() {
+		names := []string{}
+		for name := range fileCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Printf("Usage of %s file:\n\n", os.Args[0])
+		fmt.Printf("%s [options] file command [args]\n\n", os.Args[0])
+		fmt.Printf("Commands: %s\n", strings.Join(names, ", "))
+	}
+
+	if len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	command, ok := fileCommands[args[0]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	return command(d, args[1:])
+}
+
+func filePullCommand(d *ProtocolLXD, args []string) error {
+	fs := flag.NewFlagSet("file pull", flag.ExitOnError)
+	flagRecursive := fs.Bool("r", false, "Pull a directory tree into the target directory")
+	flagCompression := fs.String("compression", "none", "Compression used for recursive transfers (none, gzip or zstd)")
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s file pull:\n\n", os.Args[0])
+		fmt.Printf("%s [options] file pull [-r] [--compression ALGORITHM] <source path> <target path>\n\n", os.Args[0])
+		fmt.Printf("Use - as the target path to write to standard output.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	sourcePath := fs.Arg(0)
+	targetPath := fs.Arg(1)
+
+	if *flagRecursive {
+		return filePullArchive(d, sourcePath, targetPath, *flagCompression)
+	}
+
+	buf, resp, err := d.GetInstanceFile(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	// Directories are returned without a body
+	if buf != nil {
+		defer buf.Close()
+	}
+
+	if resp.Type == "directory" {
+		return fmt.Errorf("Path %q is a directory", sourcePath)
+	}
+
+	if targetPath == "-" {
+		_, err = io.Copy(os.Stdout, buf)
+		return err
+	}
+
+	// Pull into an existing directory
+	fi, err := os.Stat(targetPath)
+	if err == nil && fi.IsDir() {
+		targetPath = filepath.Join(targetPath, filepath.Base(sourcePath))
+	}
+
+	mode := os.FileMode(0644)
+	if resp.Mode > -1 {
+		mode = os.FileMode(resp.Mode)
+	}
+
+	f, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, buf)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// filePullArchive streams the directory tree at sourcePath into the local
+// targetPath directory.
+func filePullArchive(d *ProtocolLXD, sourcePath string, targetPath string, compression string) error {
+	compressionArgs, err := shared.TarCompressionArgs(compression)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(targetPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	buf, err := d.GetInstanceFileArchive(sourcePath, compression)
+	if err != nil {
+		return err
+	}
+	defer buf.Close()
+
+	args := append([]string{}, shared.TarExtractArgs...)
+	args = append(args, compressionArgs...)
+	args = append(args, "--directory", targetPath)
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("tar", args...)
+	cmd.Stdin = buf
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to extract archive: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// filePushArchive streams the local directory tree at sourcePath into the
+// remote targetPath directory.
+func filePushArchive(d *ProtocolLXD, sourcePath string, targetPath string, compression string) error {
+	compressionArgs, err := shared.TarCompressionArgs(compression)
+	if err != nil {
+		return err
+	}
+
+	sourcePath, err = filepath.Abs(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("Path %q isn't a directory", sourcePath)
+	}
+
+	dir, base := filepath.Dir(sourcePath), filepath.Base(sourcePath)
+	if sourcePath == "/" {
+		base = "."
+	}
+
+	args := append([]string{}, shared.TarCreateArgs...)
+	args = append(args, compressionArgs...)
+	args = append(args, "--directory", dir, base)
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("tar", args...)
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// Keep the HTTP client from closing the pipe so that tar can be drained
+	// if the upload stops early.
+	pushErr := d.CreateInstanceFileArchive(targetPath, compression, ioutil.NopCloser(stdout))
+	io.Copy(ioutil.Discard, stdout)
+
+	err = cmd.Wait()
+	if pushErr != nil {
+		return pushErr
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create archive: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func filePushCommand(d *ProtocolLXD, args []string) error {
+	fs := flag.NewFlagSet("file push", flag.ExitOnError)
+	flagUID := fs.Int64("uid", -1, "Set the file's uid on push")
+	flagGID := fs.Int64("gid", -1, "Set the file's gid on push")
+	flagMode := fs.String("mode", "", "Set the file's perms on push (default is the source file's)")
+	flagAppend := fs.Bool("append", false, "Append to the target file instead of replacing it")
+	flagRecursive := fs.Bool("r", false, "Push a directory tree into the target directory")
+	flagCompression := fs.String("compression", "none", "Compression used for recursive transfers (none, gzip or zstd)")
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s file push:\n\n", os.Args[0])
+		fmt.Printf("%s [options] file push [-r] [--compression ALGORITHM] [--uid UID] [--gid GID] [--mode MODE] [--append] <source path> <target path>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	sourcePath := fs.Arg(0)
+	targetPath := fs.Arg(1)
+
+	if *flagRecursive {
+		return filePushArchive(d, sourcePath, targetPath, *flagCompression)
+	}
+
+	// Push into a directory
+	if strings.HasSuffix(targetPath, "/") {
+		targetPath = targetPath + filepath.Base(sourcePath)
+	}
+
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	mode := int(fi.Mode().Perm())
+	if *flagMode != "" {
+		value, err := strconv.ParseInt(*flagMode, 8, 0)
+		if err != nil {
+			return fmt.Errorf("Invalid mode %q: %s", *flagMode, err)
+		}
+
+		mode = int(value)
+	}
+
+	writeMode := "overwrite"
+	if *flagAppend {
+		writeMode = "append"
+	}
+
+	return d.CreateInstanceFile(targetPath, InstanceFileArgs{
+		Content:   f,
+		UID:       *flagUID,
+		GID:       *flagGID,
+		Mode:      mode,
+		Type:      "file",
+		WriteMode: writeMode,
+	})
+}
+
+func fileListCommand(d *ProtocolLXD, args []string) error {
+	fs := flag.NewFlagSet("file ls", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s file ls:\n\n", os.Args[0])
+		fmt.Printf("%s [options] file ls <path>\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	buf, resp, err := d.GetInstanceFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if resp.Type != "directory" {
+		buf.Close()
+		return fmt.Errorf("Path %q isn't a directory", fs.Arg(0))
+	}
+
+	sort.Slice(resp.Entries, func(i, j int) bool {
+		return resp.Entries[i].Name < resp.Entries[j].Name
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	for _, entry := range resp.Entries {
+		name := entry.Name
+		if entry.Target != "" {
+			name = fmt.Sprintf("%s -> %s", entry.Name, entry.Target)
+		}
+
+		fmt.Fprintf(w, "%s\t%04o\t%d\t%d\t%d\t%s\t%s\n", entry.Type, entry.Mode, entry.UID, entry.GID, entry.Size, entry.ModTime.Format("2006-01-02 15:04"), name)
+	}
+
+	return w.Flush()
+}
+
+func fileMkdirCommand(d *ProtocolLXD, args []string) error {
+	fs := flag.NewFlagSet("file mkdir", flag.ExitOnError)
+	flagUID := fs.Int64("uid", -1, "Set the directory's uid")
+	flagGID := fs.Int64("gid", -1, "Set the directory's gid")
+	flagMode := fs.String("mode", "0755", "Set the directory's perms")
+	flagParents := fs.Bool("p", false, "Create any missing parent directories")
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s file mkdir:\n\n", os.Args[0])
+		fmt.Printf("%s [options] file mkdir [-p] [--uid UID] [--gid GID] [--mode MODE] <path>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	mode, err := strconv.ParseInt(*flagMode, 8, 0)
+	if err != nil {
+		return fmt.Errorf("Invalid mode %q: %s", *flagMode, err)
+	}
+
+	path := filepath.Clean(fs.Arg(0))
+
+	// Parents are created with default ownership and mode, existing ones are
+	// left untouched.
+	if *flagParents {
+		parents := []string{}
+		for parent := filepath.Dir(path); parent != "/" && parent != "."; parent = filepath.Dir(parent) {
+			parents = append([]string{parent}, parents...)
+		}
+
+		for _, parent := range parents {
+			err := d.CreateInstanceFile(parent, InstanceFileArgs{
+				UID:  -1,
+				GID:  -1,
+				Mode: -1,
+				Type: "directory",
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.CreateInstanceFile(path, InstanceFileArgs{
+		UID:  *flagUID,
+		GID:  *flagGID,
+		Mode: int(mode),
+		Type: "directory",
+	})
+}
+
+func fileDeleteCommand(d *ProtocolLXD, args []string) error {
+	fs := flag.NewFlagSet("file rm", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s file rm:\n\n", os.Args[0])
+		fmt.Printf("%s [options] file rm <path>...\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range fs.Args() {
+		err := d.DeleteInstanceFile(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
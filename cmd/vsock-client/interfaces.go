@@ -5,6 +5,8 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/lxc/lxd/shared/api"
+
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
 )
 
 // The Operation type represents a currently running operation.
@@ -33,3 +35,42 @@ type InstanceExecArgs struct {
 	// Channel that will be closed when all data operations are done
 	DataDone chan bool
 }
+
+// The InstanceFileArgs struct is used to pass the various options for an instance file upload.
+type InstanceFileArgs struct {
+	// File content
+	Content io.ReadSeeker
+
+	// User id that owns the file
+	UID int64
+
+	// Group id that owns the file
+	GID int64
+
+	// File permissions
+	Mode int
+
+	// File type (file, directory or symlink)
+	Type string
+
+	// File write mode (overwrite or append)
+	WriteMode string
+}
+
+// The InstanceFileResponse struct is used as part of the response for an instance file download.
+type InstanceFileResponse struct {
+	// User id that owns the file
+	UID int64
+
+	// Group id that owns the file
+	GID int64
+
+	// File permissions
+	Mode int
+
+	// File type (file or directory)
+	Type string
+
+	// Directory entries
+	Entries []vsockapi.InstanceFileEntry
+}
@@ -13,6 +13,17 @@ import (
 	"github.com/lxc/lxd/shared/logger"
 )
 
+// The statusError type is returned for HTTP errors which didn't come with an
+// API response, e.g. for endpoints unknown to the agent.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e statusError) Error() string {
+	return e.msg
+}
+
 // Internal functions
 func lxdParseResponse(resp *http.Response) (*api.Response, string, error) {
 	// Get the ETag
@@ -26,7 +37,7 @@ func lxdParseResponse(resp *http.Response) (*api.Response, string, error) {
 	if err != nil {
 		// Check the return value for a cleaner error
 		if resp.StatusCode != http.StatusOK {
-			return nil, "", fmt.Errorf("Failed to fetch %s: %s", resp.Request.URL.String(), resp.Status)
+			return nil, "", statusError{resp.StatusCode, fmt.Sprintf("Failed to fetch %s: %s", resp.Request.URL.String(), resp.Status)}
 		}
 
 		return nil, "", err
@@ -91,6 +102,11 @@ func (r *ProtocolLXD) rawWebsocket(url string) (*websocket.Conn, error) {
 		headers.Set("X-LXD-authenticated", "true")
 	}
 
+	// Set the bearer token
+	if r.httpToken != "" {
+		headers.Set("Authorization", fmt.Sprintf("Bearer %s", r.httpToken))
+	}
+
 	// Set macaroon headers if needed
 	if r.bakeryClient != nil {
 		u, err := neturl.Parse(r.httpHost) // use the http url, not the ws one
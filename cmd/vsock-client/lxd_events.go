@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// GetEvents connects to the LXD monitoring interface
+func (r *ProtocolLXD) GetEvents() (*EventListener, error) {
+	err := r.CheckExtension("events")
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect to the websocket
+	conn, err := r.websocket("/events")
+	if err != nil {
+		return nil, err
+	}
+
+	// Setup a new listener
+	listener := EventListener{
+		r:        r,
+		conn:     conn,
+		chActive: make(chan bool),
+	}
+
+	// Dispatch the events to the handlers
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				// Prevent anything else from interacting with the listener
+				listener.targetsLock.Lock()
+				listener.err = err
+				listener.targetsLock.Unlock()
+
+				close(listener.chActive)
+				return
+			}
+
+			// Attempt to unpack the message
+			event := api.Event{}
+			err = json.Unmarshal(data, &event)
+			if err != nil {
+				log.Printf("Failed to decode event: %s\n", err)
+				continue
+			}
+
+			// Extract the message type
+			if event.Type == "" {
+				continue
+			}
+
+			// Send the message to all handlers
+			listener.targetsLock.Lock()
+			for _, target := range listener.targets {
+				if target.types != nil && !shared.StringInSlice(event.Type, target.types) {
+					continue
+				}
+
+				go target.function(event)
+			}
+			listener.targetsLock.Unlock()
+		}
+	}()
+
+	return &listener, nil
+}
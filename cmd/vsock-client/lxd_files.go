@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// GetInstanceFile retrieves the provided path from the instance
+func (r *ProtocolLXD) GetInstanceFile(path string) (io.ReadCloser, *InstanceFileResponse, error) {
+	err := r.CheckExtension("files")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Prepare the HTTP request
+	requestURL := fmt.Sprintf("%s/1.0/files?path=%s", r.httpHost, url.QueryEscape(path))
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Set the user agent
+	if r.httpUserAgent != "" {
+		req.Header.Set("User-Agent", r.httpUserAgent)
+	}
+
+	// Send the request
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check the return value for a cleaner error
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		_, _, err := lxdParseResponse(resp)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, fmt.Errorf("Failed to fetch %s: %s", requestURL, resp.Status)
+	}
+
+	// Parse the headers
+	uid, gid, mode, fileType, _ := shared.ParseLXDFileHeaders(resp.Header)
+	fileResp := InstanceFileResponse{
+		UID:  uid,
+		GID:  gid,
+		Mode: mode,
+		Type: fileType,
+	}
+
+	if fileResp.Type == "directory" {
+		defer resp.Body.Close()
+
+		err := r.CheckExtension("files_directory")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Decode the response
+		response := api.Response{}
+		decoder := json.NewDecoder(resp.Body)
+
+		err = decoder.Decode(&response)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Get the file list
+		err = response.MetadataAsStruct(&fileResp.Entries)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, &fileResp, nil
+	}
+
+	return resp.Body, &fileResp, nil
+}
+
+// DeleteInstanceFile deletes a file in the instance
+func (r *ProtocolLXD) DeleteInstanceFile(path string) error {
+	err := r.CheckExtension("files_directory")
+	if err != nil {
+		return err
+	}
+
+	// Send the request
+	_, _, err = r.query("DELETE", fmt.Sprintf("/files?path=%s", url.QueryEscape(path)), nil, "")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateInstanceFile tells the agent to create a file in the instance
+func (r *ProtocolLXD) CreateInstanceFile(path string, args InstanceFileArgs) error {
+	err := r.CheckExtension("files")
+	if err != nil {
+		return err
+	}
+
+	if args.Type == "directory" || args.Type == "symlink" {
+		err := r.CheckExtension("files_directory")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Prepare the HTTP request
+	requestURL := fmt.Sprintf("%s/1.0/files?path=%s", r.httpHost, url.QueryEscape(path))
+
+	req, err := http.NewRequest("POST", requestURL, args.Content)
+	if err != nil {
+		return err
+	}
+
+	// Set the user agent
+	if r.httpUserAgent != "" {
+		req.Header.Set("User-Agent", r.httpUserAgent)
+	}
+
+	// Set the various headers
+	if args.UID > -1 {
+		req.Header.Set("X-LXD-uid", fmt.Sprintf("%d", args.UID))
+	}
+
+	if args.GID > -1 {
+		req.Header.Set("X-LXD-gid", fmt.Sprintf("%d", args.GID))
+	}
+
+	if args.Mode > -1 {
+		req.Header.Set("X-LXD-mode", fmt.Sprintf("%04o", args.Mode))
+	}
+
+	if args.Type != "" {
+		req.Header.Set("X-LXD-type", args.Type)
+	}
+
+	if args.WriteMode != "" {
+		req.Header.Set("X-LXD-write", args.WriteMode)
+	}
+
+	// Send the request
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check the return value for a cleaner error
+	_, _, err = lxdParseResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// The archiveReader type reports errors which the server sent after it
+// started streaming an archive.
+type archiveReader struct {
+	resp *http.Response
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	n, err := r.resp.Body.Read(p)
+	if err == io.EOF {
+		msg := r.resp.Trailer.Get("X-LXD-error")
+		if msg != "" {
+			return n, fmt.Errorf("%s", msg)
+		}
+	}
+
+	return n, err
+}
+
+func (r *archiveReader) Close() error {
+	return r.resp.Body.Close()
+}
+
+// GetInstanceFileArchive retrieves the directory tree at the provided path as a tar archive
+func (r *ProtocolLXD) GetInstanceFileArchive(path string, compression string) (io.ReadCloser, error) {
+	err := r.CheckExtension("files_archive")
+	if err != nil {
+		return nil, err
+	}
+
+	// Prepare the HTTP request
+	requestURL := fmt.Sprintf("%s/1.0/files/archive?path=%s&compression=%s", r.httpHost, url.QueryEscape(path), url.QueryEscape(compression))
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the user agent
+	if r.httpUserAgent != "" {
+		req.Header.Set("User-Agent", r.httpUserAgent)
+	}
+
+	// Send the request
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the return value for a cleaner error
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		_, _, err := lxdParseResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to fetch %s: %s", requestURL, resp.Status)
+	}
+
+	return &archiveReader{resp: resp}, nil
+}
+
+// CreateInstanceFileArchive extracts a tar archive into the directory at the provided path
+func (r *ProtocolLXD) CreateInstanceFileArchive(path string, compression string, content io.Reader) error {
+	err := r.CheckExtension("files_archive")
+	if err != nil {
+		return err
+	}
+
+	// Prepare the HTTP request
+	requestURL := fmt.Sprintf("%s/1.0/files/archive?path=%s&compression=%s", r.httpHost, url.QueryEscape(path), url.QueryEscape(compression))
+
+	req, err := http.NewRequest("POST", requestURL, content)
+	if err != nil {
+		return err
+	}
+
+	// Set the user agent
+	if r.httpUserAgent != "" {
+		req.Header.Set("User-Agent", r.httpUserAgent)
+	}
+
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	// Send the request
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check the return value for a cleaner error
+	_, _, err = lxdParseResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -15,11 +15,13 @@ import (
 	"github.com/lxc/lxd/shared/logger"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
 )
 
 // ProtocolLXD represents a LXD API server
 type ProtocolLXD struct {
-	server *api.Server
+	server *vsockapi.Server
 
 	http            *http.Client
 	httpCertificate string
@@ -27,6 +29,7 @@ type ProtocolLXD struct {
 	httpUnixPath    string
 	httpProtocol    string
 	httpUserAgent   string
+	httpToken       string
 
 	bakeryClient         *httpbakery.Client
 	bakeryInteractor     []httpbakery.Interactor
@@ -152,8 +155,12 @@ func (r *ProtocolLXD) rawQuery(method string, url string, data interface{}, ETag
 	return lxdParseResponse(resp)
 }
 
-// Do performs a Request, using macaroon authentication if set.
+// Do performs a Request, using bearer token or macaroon authentication if set.
 func (r *ProtocolLXD) do(req *http.Request) (*http.Response, error) {
+	if r.httpToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", r.httpToken))
+	}
+
 	if r.bakeryClient != nil {
 		r.addMacaroonHeaders(req)
 		return r.bakeryClient.Do(req)
@@ -199,7 +206,28 @@ func (r *ProtocolLXD) queryOperation(method string, path string, data interface{
 }
 
 // ExecInstance requests that LXD spawns a command inside the instance.
-func (r *ProtocolLXD) ExecInstance(instanceName string, exec api.InstanceExecPost, args *InstanceExecArgs) (Operation, error) {
+func (r *ProtocolLXD) ExecInstance(instanceName string, exec vsockapi.InstanceExecPost, args *InstanceExecArgs) (Operation, error) {
+	if exec.Cwd != "" || exec.User != nil || exec.Group != nil {
+		err := r.CheckExtension("exec_cwd_user")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if exec.Limits != (vsockapi.InstanceExecLimits{}) {
+		err := r.CheckExtension("exec_limits")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if exec.Detached {
+		err := r.CheckExtension("exec_detached")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Send the request
 	op, _, err := r.queryOperation("POST", "/exec", exec, "")
 	if err != nil {
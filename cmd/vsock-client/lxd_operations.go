@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"strings"
 
@@ -12,19 +14,26 @@ import (
 
 // GetOperationUUIDs returns a list of operation uuids
 func (r *ProtocolLXD) GetOperationUUIDs() ([]string, error) {
-	urls := []string{}
+	err := r.CheckExtension("operations")
+	if err != nil {
+		return nil, err
+	}
+
+	urls := map[string][]string{}
 
 	// Fetch the raw value
-	_, err := r.queryStruct("GET", "/operations", nil, "", &urls)
+	_, err = r.queryStruct("GET", "/operations", nil, "", &urls)
 	if err != nil {
 		return nil, err
 	}
 
 	// Parse it
 	uuids := []string{}
-	for _, url := range urls {
-		fields := strings.Split(url, "/operations/")
-		uuids = append(uuids, fields[len(fields)-1])
+	for _, v := range urls {
+		for _, url := range v {
+			fields := strings.Split(url, "/operations/")
+			uuids = append(uuids, fields[len(fields)-1])
+		}
 	}
 
 	return uuids, nil
@@ -32,10 +41,15 @@ func (r *ProtocolLXD) GetOperationUUIDs() ([]string, error) {
 
 // GetOperations returns a list of Operation struct
 func (r *ProtocolLXD) GetOperations() ([]api.Operation, error) {
+	err := r.CheckExtension("operations")
+	if err != nil {
+		return nil, err
+	}
+
 	apiOperations := map[string][]api.Operation{}
 
 	// Fetch the raw value
-	_, err := r.queryStruct("GET", "/operations?recursion=1", nil, "", &apiOperations)
+	_, err = r.queryStruct("GET", "/operations?recursion=1", nil, "", &apiOperations)
 	if err != nil {
 		return nil, err
 	}
@@ -64,8 +78,58 @@ func (r *ProtocolLXD) GetOperation(uuid string) (*api.Operation, string, error)
 	return &op, etag, nil
 }
 
+// GetOperationLogs returns the output of a detached exec operation. With
+// follow set, the output is streamed until the operation is done.
+func (r *ProtocolLXD) GetOperationLogs(uuid string, follow bool) (io.ReadCloser, error) {
+	err := r.CheckExtension("exec_detached")
+	if err != nil {
+		return nil, err
+	}
+
+	// Prepare the HTTP request
+	requestURL := fmt.Sprintf("%s/1.0/operations/%s/logs", r.httpHost, url.PathEscape(uuid))
+	if follow {
+		requestURL += "?follow=1"
+	}
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the user agent
+	if r.httpUserAgent != "" {
+		req.Header.Set("User-Agent", r.httpUserAgent)
+	}
+
+	// Send the request
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the return value for a cleaner error
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		_, _, err := lxdParseResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to fetch %s: %s", requestURL, resp.Status)
+	}
+
+	return &archiveReader{resp: resp}, nil
+}
+
 // GetOperationWait returns an Operation entry for the provided uuid once it's complete or hits the timeout
 func (r *ProtocolLXD) GetOperationWait(uuid string, timeout int) (*api.Operation, string, error) {
+	err := r.CheckExtension("operations")
+	if err != nil {
+		return nil, "", err
+	}
+
 	op := api.Operation{}
 
 	// Fetch the raw value
@@ -89,8 +153,13 @@ func (r *ProtocolLXD) GetOperationWebsocket(uuid string, secret string) (*websoc
 
 // DeleteOperation deletes (cancels) a running operation
 func (r *ProtocolLXD) DeleteOperation(uuid string) error {
+	err := r.CheckExtension("operations")
+	if err != nil {
+		return err
+	}
+
 	// Send the request
-	_, _, err := r.query("DELETE", fmt.Sprintf("/operations/%s", url.PathEscape(uuid)), nil, "")
+	_, _, err = r.query("DELETE", fmt.Sprintf("/operations/%s", url.PathEscape(uuid)), nil, "")
 	if err != nil {
 		return err
 	}
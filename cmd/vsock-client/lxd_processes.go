@@ -0,0 +1,23 @@
+package main
+
+import (
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
+)
+
+// GetProcesses returns the process table of the instance
+func (r *ProtocolLXD) GetProcesses() ([]vsockapi.Process, error) {
+	err := r.CheckExtension("processes")
+	if err != nil {
+		return nil, err
+	}
+
+	processes := []vsockapi.Process{}
+
+	// Fetch the raw value
+	_, err = r.queryStruct("GET", "/processes", nil, "", &processes)
+	if err != nil {
+		return nil, err
+	}
+
+	return processes, nil
+}
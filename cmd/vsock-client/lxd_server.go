@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
+)
+
+// GetServer returns the agent status as a Server struct
+func (r *ProtocolLXD) GetServer() (*vsockapi.Server, string, error) {
+	server := vsockapi.Server{}
+
+	// Fetch the raw value
+	etag, err := r.queryStruct("GET", "", nil, "", &server)
+	if err != nil {
+		// Agents predating API extensions don't serve /1.0
+		statusErr, ok := err.(statusError)
+		if !ok || statusErr.status != http.StatusNotFound {
+			return nil, "", err
+		}
+
+		log.Println("The agent doesn't support API extensions")
+		server = vsockapi.Server{APIExtensions: []string{}}
+	}
+
+	// Add the value to the cache
+	r.server = &server
+
+	return &server, etag, nil
+}
+
+// HasExtension returns true if the agent supports a given API extension
+func (r *ProtocolLXD) HasExtension(extension string) bool {
+	// If no cached API information, just assume we're good
+	// This is needed for those rare cases where we must avoid a GetServer call
+	if r.server == nil {
+		return true
+	}
+
+	for _, entry := range r.server.APIExtensions {
+		if entry == extension {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckExtension returns an error if the agent doesn't support a given API extension
+func (r *ProtocolLXD) CheckExtension(extension string) error {
+	if !r.HasExtension(extension) {
+		return fmt.Errorf("The agent is too old, it is missing the required %q API extension", extension)
+	}
+
+	return nil
+}
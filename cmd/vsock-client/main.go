@@ -1,84 +1,355 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/termios"
-	"github.com/mdlayher/vsock"
+	"github.com/lxc/lxd/shared/units"
 	"github.com/pkg/errors"
+
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
 )
 
 var flagPort uint64
 var flagContext uint64
+var flagConnect string
+var flagCert string
+var flagKey string
+var flagCA string
+var flagToken string
+var flagTokenFile string
+
+// Exit codes used when the remote command didn't provide one
+const (
+	exitInterrupted        = 130
+	exitOperationCancelled = 254
+	exitOperationFailed    = 255
+)
+
+// exitCode is the status the process exits with once the command is done
+var exitCode int
 
 func init() {
 	flag.Uint64Var(&flagPort, "port", 8443, "Port to connect to")
 	flag.Uint64Var(&flagContext, "context", 3, "Context ID")
+	flag.StringVar(&flagConnect, "connect", "", "Address to connect to (vsock://CID:PORT, unix:///PATH or tcp://HOST:PORT), overrides -context and -port")
+	flag.StringVar(&flagCert, "cert", "", "Client certificate")
+	flag.StringVar(&flagKey, "key", "", "Client key")
+	flag.StringVar(&flagCA, "ca", "", "Server certificate or CA, enables TLS")
+	flag.StringVar(&flagToken, "token", "", "Bearer token (default $VSOCK_TOKEN or the content of -token-file)")
+	flag.StringVar(&flagTokenFile, "token-file", defaultTokenFile(), "File containing the bearer token")
 }
 
-var handlers = map[string]func(http.Client, string) (*http.Response, error){
-	"/state": stateHandler,
-	"/exec":  execHandler,
+// defaultTokenFile returns the path of the token file in the user's
+// configuration directory.
+func defaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "vsock", "token")
 }
 
-var args []string
+// bearerToken returns the token given by -token, $VSOCK_TOKEN or the token
+// file, in that order.
+func bearerToken() (string, error) {
+	if flagToken != "" {
+		return flagToken, nil
+	}
+
+	token := os.Getenv("VSOCK_TOKEN")
+	if token != "" {
+		return token, nil
+	}
+
+	if flagTokenFile == "" {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadFile(flagTokenFile)
+	if err != nil {
+		// The default token file is optional
+		if os.IsNotExist(err) && flagTokenFile == defaultTokenFile() {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+var commands = map[string]func(*ProtocolLXD, []string) error{
+	"state": stateCommand,
+	"exec":  execCommand,
+	"file":  fileCommand,
+	"info":  infoCommand,
+	"ps":    processesCommand,
+}
 
 func main() {
 	flag.Usage = func() {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
 		fmt.Printf("Usage of %s:\n\n", os.Args[0])
-		fmt.Printf("%s [options] method path\n\n", os.Args[0])
+		fmt.Printf("%s [options] command [args]\n\n", os.Args[0])
+		fmt.Printf("Commands: %s\n\n", strings.Join(names, ", "))
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
-	if len(flag.Args()) != 2 {
+	if len(flag.Args()) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
 		flag.Usage()
 		os.Exit(2)
 	}
 
+	address := flagConnect
+	if address == "" {
+		address = fmt.Sprintf("vsock://%d:%d", flagContext, flagPort)
+	}
+
+	dial, err := dialer(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	transport := &http.Transport{
+		Dial: dial,
+	}
+
 	client := http.Client{
-		Transport: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return vsock.Dial(uint32(flagContext), uint32(flagPort))
-			},
-		},
+		Transport: transport,
 	}
 
-	// New HTTP request
-	resp, err := handlers[flag.Arg(1)](client, flag.Arg(0))
+	d := &ProtocolLXD{
+		http:     &client,
+		httpHost: "http://vm.socket",
+	}
+
+	token, err := bearerToken()
 	if err != nil {
 		log.Fatal(err)
 	}
+	d.httpToken = token
 
-	if resp == nil {
-		return
+	if flagCert != "" || flagCA != "" {
+		if flagCA == "" || (flagCert == "") != (flagKey == "") {
+			log.Fatal("TLS requires -ca, and -cert together with -key")
+		}
+
+		serverCert, err := ioutil.ReadFile(flagCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		d.httpCertificate = string(serverCert)
+		d.httpHost = "https://vm.socket"
+
+		transport.TLSClientConfig, err = clientTLSConfig(flagCert, flagKey, d.httpCertificate)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
+	// Find out what the agent supports before talking to it
+	_, _, err = d.GetServer()
+	if err == nil {
+		err = command(d, flag.Args()[1:])
+	}
+
+	if err != nil {
+		log.Println(err)
+
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+
+	os.Exit(exitCode)
+}
+
+func infoCommand(d *ProtocolLXD, args []string) error {
+	data, err := json.MarshalIndent(d.server, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+
+	return nil
+}
+
+func stateCommand(d *ProtocolLXD, args []string) error {
+	// Older agents still answer but with incomplete data
+	if !d.HasExtension("state_cgroup_v2") {
+		log.Println("Warning: the agent is too old to report CPU and memory usage on cgroup v2 guests")
+	}
+
+	if !d.HasExtension("state_disk") {
+		log.Println("Warning: the agent is too old to report disk usage")
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/state", d.httpHost), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	fmt.Println(string(body))
+
+	return nil
+}
+
+func processesCommand(d *ProtocolLXD, args []string) error {
+	processes, err := d.GetProcesses()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "PID\tPPID\tUSER\tSTATE\tRSS\tTIME\tCOMMAND\n")
+	for _, process := range processes {
+		command := strings.Join(process.Command, " ")
+		if command == "" {
+			command = fmt.Sprintf("[%s]", process.Name)
+		}
+
+		username := process.User
+		if username == "" {
+			username = fmt.Sprintf("%d", process.UID)
+		}
+
+		cpuTime := time.Duration(process.CPUTime).Round(time.Second)
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%s\t%s\n", process.PID, process.PPID, username, process.State, process.RSS/1024, cpuTime, command)
+	}
+
+	return w.Flush()
 }
 
-func stateHandler(client http.Client, method string) (*http.Response, error) {
-	return client.Get("http://vsock/state")
+// envFlag collects repeated KEY=VALUE flags.
+type envFlag map[string]string
+
+func (e envFlag) String() string {
+	pairs := []string{}
+	for k, v := range e {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (e envFlag) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return fmt.Errorf("Bad key=value pair: %s", value)
+	}
+
+	e[fields[0]] = fields[1]
+	return nil
 }
 
-func execHandler(client http.Client, method string) (*http.Response, error) {
+func execCommand(d *ProtocolLXD, args []string) error {
 	var err error
 
+	if len(args) > 0 && args[0] == "attach" {
+		return execAttachCommand(d, args[1:])
+	}
+
+	flagEnv := envFlag{}
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	fs.Var(flagEnv, "env", "Environment variable to set (e.g. HOME=/home/foo)")
+	flagCwd := fs.String("cwd", "", "Directory to run the command in")
+	flagUser := fs.Uint("user", 0, "User ID to run the command as (default the server's user)")
+	flagGroup := fs.Uint("group", 0, "Group ID to run the command as (default the server's group)")
+	flagTimeout := fs.Duration("timeout", 0, "Kill the command after this long")
+	flagLimitCPUTime := fs.Uint64("limit-cpu-time", 0, "CPU time limit in seconds")
+	flagLimitFiles := fs.Uint64("limit-files", 0, "Maximum number of open files")
+	flagLimitAddressSpace := fs.String("limit-address-space", "", "Maximum address space size (e.g. 1GiB)")
+	flagLimitProcesses := fs.Uint64("limit-processes", 0, "Maximum number of processes of the user")
+	flagLimitMemory := fs.String("limit-memory", "", "Memory limit of the command's cgroup (e.g. 512MiB)")
+	flagLimitCPUs := fs.Float64("limit-cpus", 0, "CPU limit of the command's cgroup in CPUs (e.g. 0.5)")
+	flagDetach := fs.Bool("d", false, "Run the command in the background and print its operation ID")
+	flagForceInteractive := fs.Bool("t", false, "Force pseudo-terminal allocation")
+	flagForceNonInteractive := fs.Bool("T", false, "Disable pseudo-terminal allocation")
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s exec:\n\n", os.Args[0])
+		fmt.Printf("%s [options] exec [--env K=V]... [--cwd DIR] [--user UID] [--group GID] [--timeout DURATION] [--limit-LIMIT VALUE]... [-d|-t|-T] -- command [args...]\n", os.Args[0])
+		fmt.Printf("%s [options] exec attach <operation ID>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *flagForceInteractive && *flagForceNonInteractive {
+		return fmt.Errorf("You can't pass -t and -T at the same time")
+	}
+
+	limits := vsockapi.InstanceExecLimits{
+		Timeout:   int64((*flagTimeout + time.Second - 1) / time.Second),
+		CPUTime:   *flagLimitCPUTime,
+		Files:     *flagLimitFiles,
+		Processes: *flagLimitProcesses,
+		CPUs:      *flagLimitCPUs,
+	}
+
+	if *flagLimitAddressSpace != "" {
+		value, err := units.ParseByteSizeString(*flagLimitAddressSpace)
+		if err != nil {
+			return errors.Wrap(err, "Invalid address space limit")
+		}
+
+		limits.AddressSpace = uint64(value)
+	}
+
+	if *flagLimitMemory != "" {
+		limits.Memory, err = units.ParseByteSizeString(*flagLimitMemory)
+		if err != nil {
+			return errors.Wrap(err, "Invalid memory limit")
+		}
+	}
+
 	// Set the environment
 	env := map[string]string{}
 	myTerm, ok := getTERM()
@@ -86,6 +357,48 @@ func execHandler(client http.Client, method string) (*http.Response, error) {
 		env["TERM"] = myTerm
 	}
 
+	for k, v := range flagEnv {
+		env[k] = v
+	}
+
+	// Prepare the command
+	req := vsockapi.InstanceExecPost{
+		Command:     fs.Args(),
+		Environment: env,
+		Cwd:         *flagCwd,
+		Limits:      limits,
+	}
+
+	// Only send the user and group if given, the server keeps its own otherwise
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "user":
+			uid := uint32(*flagUser)
+			req.User = &uid
+		case "group":
+			gid := uint32(*flagGroup)
+			req.Group = &gid
+		}
+	})
+
+	// Detached commands run on their own, "exec attach" follows their output
+	if *flagDetach {
+		if *flagForceInteractive {
+			return fmt.Errorf("You can't pass -t and -d at the same time")
+		}
+
+		req.Detached = true
+
+		op, err := d.ExecInstance("", req, nil)
+		if err != nil {
+			return errors.Wrap(err, "ExecInstance")
+		}
+
+		fmt.Println(op.Get().ID)
+
+		return nil
+	}
+
 	// Configure the terminal
 	stdinFd := unix.Stdin
 	stdoutFd := unix.Stdout
@@ -94,17 +407,25 @@ func execHandler(client http.Client, method string) (*http.Response, error) {
 	stdoutTerminal := termios.IsTerminal(stdoutFd)
 
 	// Determine interaction mode
-	interactive := false
+	var interactive bool
+	if *flagForceInteractive {
+		interactive = true
+	} else if *flagForceNonInteractive {
+		interactive = false
+	} else {
+		interactive = stdinTerminal && stdoutTerminal
+	}
 
 	// Record terminal state
-	var oldttystate *termios.State
+	restore := func() {}
 	if interactive && stdinTerminal {
-		oldttystate, err = termios.MakeRaw(stdinFd)
+		oldttystate, err := termios.MakeRaw(stdinFd)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		defer termios.Restore(stdinFd, oldttystate)
+		restore = func() { termios.Restore(stdinFd, oldttystate) }
+		defer restore()
 	}
 
 	// Setup interactive console handler
@@ -118,22 +439,17 @@ func execHandler(client http.Client, method string) (*http.Response, error) {
 	if stdoutTerminal {
 		width, height, err = termios.GetSize(unix.Stdout)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	stdin := os.Stdin
 	stdout := os.Stdout
 
-	// Prepare the command
-	req := api.InstanceExecPost{
-		Command:     []string{"ls", "-l", "/"},
-		WaitForWS:   true,
-		Interactive: interactive,
-		Environment: env,
-		Width:       width,
-		Height:      height,
-	}
+	req.WaitForWS = true
+	req.Interactive = interactive
+	req.Width = width
+	req.Height = height
 
 	execArgs := InstanceExecArgs{
 		Stdin:    stdin,
@@ -143,26 +459,122 @@ func execHandler(client http.Client, method string) (*http.Response, error) {
 		DataDone: make(chan bool),
 	}
 
-	d := ProtocolLXD{
-		http:     &client,
-		httpHost: "http://vm.socket",
-	}
-
 	op, err := d.ExecInstance("", req, &execArgs)
 	if err != nil {
-		return nil, errors.Wrap(err, "ExecInstance")
+		return errors.Wrap(err, "ExecInstance")
 	}
 
+	chSignal := make(chan os.Signal, 1)
+	signal.Notify(chSignal, unix.SIGINT)
+	defer signal.Stop(chSignal)
+
+	go execCancelOnInterrupt(d, op, chSignal, handler != nil, restore)
+
 	// Wait for the operation to complete
 	err = op.Wait()
-	if err != nil {
-		return nil, errors.Wrap(err, "op.Wait")
+	opAPI := op.Get()
+
+	if opAPI.StatusCode == api.Cancelled {
+		return execStatus(opAPI)
 	}
 
-	op.Get()
+	if err != nil {
+		exitCode = exitOperationFailed
+		return errors.Wrap(err, "op.Wait")
+	}
 
 	// Wait for any remaining I/O to be flushed
 	<-execArgs.DataDone
 
-	return nil, nil
+	return execStatus(opAPI)
+}
+
+// execStatus sets the exit code to the exit status of the remote command.
+func execStatus(opAPI api.Operation) error {
+	if opAPI.StatusCode == api.Cancelled {
+		exitCode = exitOperationCancelled
+		return fmt.Errorf("Operation %s was cancelled", opAPI.ID)
+	}
+
+	if opAPI.StatusCode == api.Failure {
+		exitCode = exitOperationFailed
+		return fmt.Errorf("Operation %s failed: %s", opAPI.ID, opAPI.Err)
+	}
+
+	// Propagate the exit status of the remote command
+	exitStatusRaw, ok := opAPI.Metadata["return"].(float64)
+	if !ok {
+		exitCode = exitOperationFailed
+		return fmt.Errorf("Operation %s didn't report an exit status", opAPI.ID)
+	}
+
+	exitCode = int(exitStatusRaw)
+
+	reason, ok := opAPI.Metadata["reason"].(string)
+	if ok {
+		return fmt.Errorf("The command exceeded its %s limit", strings.Replace(reason, "_", " ", -1))
+	}
+
+	return nil
+}
+
+// execAttachCommand prints the output of a detached command until it's done
+// and exits with its exit status.
+func execAttachCommand(d *ProtocolLXD, args []string) error {
+	fs := flag.NewFlagSet("exec attach", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage of %s exec attach:\n\n", os.Args[0])
+		fmt.Printf("%s [options] exec attach <operation ID>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	logs, err := d.GetOperationLogs(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	_, err = io.Copy(os.Stdout, logs)
+	if err != nil {
+		return err
+	}
+
+	opAPI, _, err := d.GetOperation(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return execStatus(*opAPI)
+}
+
+// execCancelOnInterrupt cancels the remote command and exits on the second
+// SIGINT. The first one is forwarded to the command by the control handler in
+// interactive mode and only warns otherwise.
+func execCancelOnInterrupt(d *ProtocolLXD, op Operation, chSignal chan os.Signal, forwarded bool, restore func()) {
+	<-chSignal
+
+	if !forwarded {
+		log.Println("Press Ctrl-C again to cancel the remote command")
+	}
+
+	<-chSignal
+
+	restore()
+
+	err := d.CheckExtension("exec_cancel")
+	if err == nil {
+		err = op.Cancel()
+	}
+
+	if err != nil {
+		log.Printf("Failed to cancel the remote command: %v\n", err)
+	}
+
+	os.Exit(exitInterrupted)
 }
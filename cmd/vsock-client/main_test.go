@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+func TestExecStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       api.Operation
+		exitCode int
+		err      bool
+	}{
+		{
+			name: "success",
+			op: api.Operation{
+				StatusCode: api.Success,
+				Metadata:   map[string]interface{}{"return": float64(0)},
+			},
+			exitCode: 0,
+		},
+		{
+			name: "non-zero exit status",
+			op: api.Operation{
+				StatusCode: api.Success,
+				Metadata:   map[string]interface{}{"return": float64(3)},
+			},
+			exitCode: 3,
+		},
+		{
+			name: "killed by a signal",
+			op: api.Operation{
+				StatusCode: api.Success,
+				Metadata:   map[string]interface{}{"return": float64(137)},
+			},
+			exitCode: 137,
+		},
+		{
+			name: "limit exceeded",
+			op: api.Operation{
+				StatusCode: api.Success,
+				Metadata:   map[string]interface{}{"return": float64(137), "reason": "timeout"},
+			},
+			exitCode: 137,
+			err:      true,
+		},
+		{
+			name: "missing exit status",
+			op: api.Operation{
+				StatusCode: api.Success,
+				Metadata:   map[string]interface{}{},
+			},
+			exitCode: exitOperationFailed,
+			err:      true,
+		},
+		{
+			name:     "cancelled",
+			op:       api.Operation{StatusCode: api.Cancelled},
+			exitCode: exitOperationCancelled,
+			err:      true,
+		},
+		{
+			name:     "failed",
+			op:       api.Operation{StatusCode: api.Failure, Err: "boom"},
+			exitCode: exitOperationFailed,
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exitCode = 0
+
+			err := execStatus(test.op)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if exitCode != test.exitCode {
+				t.Fatalf("Expected exit code %d, got %d", test.exitCode, exitCode)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync"
 
@@ -14,6 +15,7 @@ type operation struct {
 	api.Operation
 
 	r            *ProtocolLXD
+	listener     *EventListener
 	handlerReady bool
 	handlerLock  sync.Mutex
 
@@ -86,11 +88,97 @@ func (op *operation) setupListener() error {
 		return nil
 	}
 	op.handlerReady = true
+
+	// Agents without events can only be waited on
+	if !op.r.HasExtension("events") {
+		return op.setupWaiter()
+	}
+
+	// Get a new listener
+	if op.listener == nil {
+		listener, err := op.r.GetEvents()
+		if err != nil {
+			return err
+		}
+
+		op.listener = listener
+	}
+
+	// Setup the handler
 	chReady := make(chan bool)
+	_, err := op.listener.AddHandler([]string{"operation"}, func(event api.Event) {
+		<-chReady
+
+		// We don't want concurrency while processing events
+		op.handlerLock.Lock()
+		defer op.handlerLock.Unlock()
+
+		// Check if we're done already (because of another event)
+		if op.listener == nil {
+			return
+		}
+
+		// Get an operation struct out of this data
+		newOp := op.extractOperation(event.Metadata)
+		if newOp == nil {
+			return
+		}
+
+		// We don't use the lock here because we are already locked
+		op.Operation = *newOp
+
+		// And check if we're done
+		if op.StatusCode.IsFinal() {
+			op.listener.Disconnect()
+			op.listener = nil
+			close(op.chActive)
+			return
+		}
+	})
+	if err != nil {
+		op.listener.Disconnect()
+		op.listener = nil
+		close(op.chActive)
+		close(chReady)
+
+		return err
+	}
+
+	// Monitor event listener
+	go func() {
+		<-chReady
+
+		// We don't want concurrency while accessing the listener
+		op.handlerLock.Lock()
+
+		// Check if we're done already (because of another event)
+		listener := op.listener
+		if listener == nil {
+			op.handlerLock.Unlock()
+			return
+		}
+		op.handlerLock.Unlock()
+
+		// Wait for the listener or operation to be done
+		select {
+		case <-listener.chActive:
+			op.handlerLock.Lock()
+			if op.listener != nil {
+				op.Err = fmt.Sprintf("%v", listener.err)
+				op.listener = nil
+				close(op.chActive)
+			}
+			op.handlerLock.Unlock()
+		case <-op.chActive:
+			return
+		}
+	}()
 
 	// And do a manual refresh to avoid races
-	err := op.Refresh()
+	err = op.Refresh()
 	if err != nil {
+		op.listener.Disconnect()
+		op.listener = nil
 		close(op.chActive)
 		close(chReady)
 
@@ -99,6 +187,8 @@ func (op *operation) setupListener() error {
 
 	// Check if not done already
 	if op.StatusCode.IsFinal() {
+		op.listener.Disconnect()
+		op.listener = nil
 		close(op.chActive)
 		close(chReady)
 
@@ -115,6 +205,49 @@ func (op *operation) setupListener() error {
 	return nil
 }
 
+// setupWaiter waits for the operation in the background using the wait
+// endpoint. It is a fallback for agents which don't support events and must be
+// called with handlerLock held.
+func (op *operation) setupWaiter() error {
+	err := op.r.CheckExtension("operations")
+	if err != nil {
+		close(op.chActive)
+		return err
+	}
+
+	go func() {
+		newOp, _, err := op.r.GetOperationWait(op.ID, -1)
+
+		op.handlerLock.Lock()
+		if err != nil {
+			op.Err = err.Error()
+		} else {
+			op.Operation = *newOp
+		}
+		op.handlerLock.Unlock()
+
+		close(op.chActive)
+	}()
+
+	return nil
+}
+
+func (op *operation) extractOperation(data json.RawMessage) *api.Operation {
+	// Get an operation struct out of this data
+	newOp := api.Operation{}
+	err := json.Unmarshal(data, &newOp)
+	if err != nil {
+		return nil
+	}
+
+	// And check if it's ours
+	if newOp.ID != op.ID {
+		return nil
+	}
+
+	return &newOp
+}
+
 // The remoteOperation type represents an ongoing LXD operation between two servers
 type remoteOperation struct {
 	targetOp Operation
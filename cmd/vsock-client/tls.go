@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// clientTLSConfig returns a TLS configuration presenting the given client
+// certificate and only accepting servers whose certificate is, or is signed
+// by, serverCert. vsock addresses have no name, so host names aren't checked.
+func clientTLSConfig(certFile string, keyFile string, serverCert string) (*tls.Config, error) {
+	block, _ := pem.Decode([]byte(serverCert))
+	if block == nil {
+		return nil, fmt.Errorf("Failed to decode server certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse server certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := []*x509.Certificate{}
+			for _, rawCert := range rawCerts {
+				cert, err := x509.ParseCertificate(rawCert)
+				if err != nil {
+					return err
+				}
+
+				certs = append(certs, cert)
+			}
+
+			if len(certs) == 0 {
+				return fmt.Errorf("No server certificate provided")
+			}
+
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+
+			_, err := certs[0].Verify(opts)
+			if err != nil {
+				return fmt.Errorf("Server certificate isn't trusted: %v", err)
+			}
+
+			return nil
+		},
+	}
+
+	if certFile != "" {
+		keypair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %v", err)
+		}
+
+		config.Certificates = []tls.Certificate{keypair}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/monstermunchkin/vsock/shared"
+	"github.com/monstermunchkin/vsock/shared/api"
+	"github.com/monstermunchkin/vsock/shared/version"
+)
+
+// api10Get returns the agent version and supported API extensions together
+// with information about the guest.
+func api10Get(w http.ResponseWriter, r *http.Request) Response {
+	env := shared.RenderEnvironment()
+	env.AgentPid = os.Getpid()
+	env.AgentVersion = version.Version
+	env.Addresses = listenAddresses
+	env.VsockPort = vsockPort(listenAddresses)
+	env.VsockCID = listenVsockCID
+
+	srv := api.Server{
+		APIExtensions: version.APIExtensions,
+		APIStatus:     "stable",
+		APIVersion:    version.APIVersion,
+		Environment:   env,
+	}
+
+	return SyncResponse(true, srv)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+// auditLog is where audit entries are written to, nil if auditing is disabled.
+var auditLog auditSink
+var auditLock sync.Mutex
+
+// auditEntry is a line of the audit log. Requests are logged once they've
+// been served and operations on every status change.
+type auditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+
+	// The client and the request, for operations the one creating them
+	Peer     string `json:"peer,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Status   int    `json:"status,omitempty"`
+
+	Operation       string `json:"operation,omitempty"`
+	OperationStatus string `json:"operation_status,omitempty"`
+
+	// Exec details
+	Command     []string          `json:"command,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Cwd         string            `json:"cwd,omitempty"`
+	User        *uint32           `json:"user,omitempty"`
+	Group       *uint32           `json:"group,omitempty"`
+	ExitCode    *int              `json:"exit_code,omitempty"`
+	Reason      string            `json:"reason,omitempty"`
+
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// auditRequestor identifies the client behind a request.
+type auditRequestor struct {
+	peer     string
+	identity string
+	method   string
+	endpoint string
+}
+
+// newAuditRequestor returns the requestor of r.
+func newAuditRequestor(r *http.Request) *auditRequestor {
+	peer, _ := peerName(r)
+
+	return &auditRequestor{
+		peer:     peer,
+		identity: auditIdentity(r),
+		method:   r.Method,
+		endpoint: r.URL.Path,
+	}
+}
+
+// auditIdentity returns the fingerprint of the client certificate and of the
+// bearer token of r. Tokens are hashed so they don't end up in the log.
+func auditIdentity(r *http.Request) string {
+	identities := []string{}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		fingerprint := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		identities = append(identities, fmt.Sprintf("certificate:%s", hex.EncodeToString(fingerprint[:])))
+	}
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		fingerprint := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		identities = append(identities, fmt.Sprintf("token:%s", hex.EncodeToString(fingerprint[:8])))
+	}
+
+	return strings.Join(identities, ",")
+}
+
+// audit writes entry to the audit log.
+func audit(entry auditEntry) {
+	if auditLog == nil {
+		return
+	}
+
+	entry.Timestamp = time.Now().UTC()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit log entry: %v\n", err)
+		return
+	}
+
+	auditLock.Lock()
+	err = auditLog.Write(line)
+	auditLock.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to write audit log entry: %v\n", err)
+	}
+}
+
+// auditResponseWriter records the status code of a response.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+
+	w.status = http.StatusSwitchingProtocols
+
+	return hijacker.Hijack()
+}
+
+// auditHandler logs every request served by next, including the ones denied
+// by the policy or token checks.
+func auditHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestor := newAuditRequestor(r)
+
+		aw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		entry := auditEntry{
+			Type:     "request",
+			Peer:     requestor.peer,
+			Identity: requestor.identity,
+			Method:   requestor.method,
+			Endpoint: requestor.endpoint,
+			Path:     r.URL.Query().Get("path"),
+			Status:   aw.status,
+			Duration: time.Since(start).Seconds(),
+		}
+
+		// Requests creating operations point to them
+		location := aw.Header().Get("Location")
+		if strings.HasPrefix(location, "/1.0/operations/") {
+			entry.Operation = strings.TrimPrefix(location, "/1.0/operations/")
+		}
+
+		audit(entry)
+	})
+}
+
+// auditOperation logs the rendered state md of op if its status changed.
+func auditOperation(op *operation, md *api.Operation) {
+	if auditLog == nil {
+		return
+	}
+
+	op.auditLock.Lock()
+	if op.auditStatus == md.StatusCode {
+		op.auditLock.Unlock()
+		return
+	}
+
+	op.auditStatus = md.StatusCode
+	op.auditLock.Unlock()
+
+	entry := auditEntry{
+		Type:            "operation",
+		Operation:       md.ID,
+		OperationStatus: md.Status,
+		Error:           md.Err,
+	}
+
+	if op.requestor != nil {
+		entry.Peer = op.requestor.peer
+		entry.Identity = op.requestor.identity
+		entry.Method = op.requestor.method
+		entry.Endpoint = op.requestor.endpoint
+	}
+
+	if md.StatusCode.IsFinal() {
+		entry.Duration = time.Since(md.CreatedAt).Seconds()
+	}
+
+	// Exec operations describe the command when created and report its exit
+	// status when done
+	metadata := struct {
+		Command     []string          `json:"command"`
+		Environment map[string]string `json:"environment"`
+		Cwd         string            `json:"cwd"`
+		User        *uint32           `json:"user"`
+		Group       *uint32           `json:"group"`
+		Return      *int              `json:"return"`
+		Reason      string            `json:"reason"`
+	}{}
+
+	content, err := json.Marshal(md.Metadata)
+	if err == nil {
+		err = json.Unmarshal(content, &metadata)
+	}
+
+	if err != nil {
+		log.Printf("Failed to parse metadata of %s Operation: %s: %s\n", op.class.String(), op.id, err)
+	}
+
+	entry.Command = metadata.Command
+	entry.Environment = metadata.Environment
+	entry.Cwd = metadata.Cwd
+	entry.User = metadata.User
+	entry.Group = metadata.Group
+	entry.ExitCode = metadata.Return
+	entry.Reason = metadata.Reason
+
+	audit(entry)
+}
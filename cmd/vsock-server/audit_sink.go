@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// journaldSocket is the socket of the journald native protocol.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// auditSink writes encoded audit log entries.
+type auditSink interface {
+	Write(entry []byte) error
+	Close() error
+}
+
+// newAuditSink returns the sink for target, which is "syslog", "journald" or
+// the absolute path of a log file. Log files are rotated once they grow
+// beyond maxSize, keeping up to maxFiles rotated files.
+func newAuditSink(target string, maxSize int64, maxFiles int) (auditSink, error) {
+	switch target {
+	case "syslog":
+		return newAuditSyslogSink()
+	case "journald":
+		return newAuditJournaldSink()
+	}
+
+	if !filepath.IsAbs(target) {
+		return nil, fmt.Errorf("Invalid audit log %q: must be syslog, journald or an absolute path", target)
+	}
+
+	return newAuditFileSink(target, maxSize, maxFiles)
+}
+
+// auditFileSink writes entries as JSON lines to a rotated file.
+type auditFileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+func newAuditFileSink(path string, maxSize int64, maxFiles int) (*auditFileSink, error) {
+	s := &auditFileSink{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *auditFileSink) open() error {
+	err := os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.size = fi.Size()
+
+	return nil
+}
+
+// rotate moves the log file to path.1, path.1 to path.2 and so on, dropping
+// the oldest file, and starts a new log file. The current log file is kept
+// open if that fails.
+func (s *auditFileSink) rotate() error {
+	// Create the new log file first so that a failure leaves everything as is
+	newPath := fmt.Sprintf("%s.new", s.path)
+
+	f, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = s.shift()
+	if err == nil {
+		err = os.Rename(newPath, s.path)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(newPath)
+		return err
+	}
+
+	s.f.Close()
+	s.f = f
+	s.size = 0
+
+	return nil
+}
+
+// shift moves the log file and the rotated files one place down.
+func (s *auditFileSink) shift() error {
+	for i := s.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	var err error
+	if s.maxFiles > 0 {
+		err = os.Rename(s.path, fmt.Sprintf("%s.1", s.path))
+	} else {
+		err = os.Remove(s.path)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *auditFileSink) Write(entry []byte) error {
+	line := append(entry, '\n')
+
+	// Keep writing to the current log file if it can't be rotated
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		err := s.rotate()
+		if err != nil {
+			log.Printf("Failed to rotate %q: %v\n", s.path, err)
+		}
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+func (s *auditFileSink) Close() error {
+	return s.f.Close()
+}
+
+// auditSyslogSink sends entries to the local syslog daemon.
+type auditSyslogSink struct {
+	w *syslog.Writer
+}
+
+func newAuditSyslogSink() (*auditSyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "vsock-server")
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditSyslogSink{w: w}, nil
+}
+
+func (s *auditSyslogSink) Write(entry []byte) error {
+	return s.w.Info(string(entry))
+}
+
+func (s *auditSyslogSink) Close() error {
+	return s.w.Close()
+}
+
+// auditJournaldSink sends entries to journald using its native protocol.
+type auditJournaldSink struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+func newAuditJournaldSink() (*auditJournaldSink, error) {
+	_, err := os.Stat(journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket isn't connected as file descriptors can only be passed
+	// with an explicit destination
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditJournaldSink{
+		conn: conn,
+		addr: &net.UnixAddr{Name: journaldSocket, Net: "unixgram"},
+	}, nil
+}
+
+// journaldField encodes a field of the native protocol. Values containing
+// newlines are prefixed with their length.
+func journaldField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (s *auditJournaldSink) Write(entry []byte) error {
+	buf := &bytes.Buffer{}
+	journaldField(buf, "MESSAGE", string(entry))
+	journaldField(buf, "PRIORITY", "6")
+	journaldField(buf, "SYSLOG_IDENTIFIER", "vsock-server")
+	journaldField(buf, "SYSLOG_FACILITY", "4")
+
+	_, _, err := s.conn.WriteMsgUnix(buf.Bytes(), nil, s.addr)
+	if err == nil {
+		return nil
+	}
+
+	// Entries too large for a datagram are passed in a sealed memfd
+	if !errors.Is(err, unix.EMSGSIZE) && !errors.Is(err, unix.ENOBUFS) {
+		return err
+	}
+
+	fd, err := unix.MemfdCreate("vsock-server-audit", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+
+	f := os.NewFile(uintptr(fd), "memfd")
+	defer f.Close()
+
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = s.conn.WriteMsgUnix(nil, unix.UnixRights(int(f.Fd())), s.addr)
+
+	return err
+}
+
+func (s *auditJournaldSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAuditFileSinkRotate(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxFiles int
+		existing string
+		entries  []string
+		files    map[string]string
+	}{
+		{
+			name:     "below the size limit",
+			maxSize:  100,
+			maxFiles: 2,
+			entries:  []string{"aaaa", "bbbb"},
+			files:    map[string]string{"audit.log": "aaaa\nbbbb\n"},
+		},
+		{
+			name:     "rotated",
+			maxSize:  10,
+			maxFiles: 2,
+			entries:  []string{"aaaa", "bbbb", "cccc"},
+			files: map[string]string{
+				"audit.log":   "cccc\n",
+				"audit.log.1": "aaaa\nbbbb\n",
+			},
+		},
+		{
+			name:     "oldest file dropped",
+			maxSize:  5,
+			maxFiles: 2,
+			entries:  []string{"aaaa", "bbbb", "cccc", "dddd"},
+			files: map[string]string{
+				"audit.log":   "dddd\n",
+				"audit.log.1": "cccc\n",
+				"audit.log.2": "bbbb\n",
+			},
+		},
+		{
+			name:     "no rotated files kept",
+			maxSize:  5,
+			maxFiles: 0,
+			entries:  []string{"aaaa", "bbbb"},
+			files:    map[string]string{"audit.log": "bbbb\n"},
+		},
+		{
+			name:     "no size limit",
+			maxSize:  0,
+			maxFiles: 2,
+			entries:  []string{"aaaa", "bbbb", "cccc"},
+			files:    map[string]string{"audit.log": "aaaa\nbbbb\ncccc\n"},
+		},
+		{
+			name:     "existing file",
+			maxSize:  10,
+			maxFiles: 2,
+			existing: "old\n",
+			entries:  []string{"new", "more"},
+			files: map[string]string{
+				"audit.log":   "more\n",
+				"audit.log.1": "old\nnew\n",
+			},
+		},
+		{
+			name:     "entry larger than the size limit",
+			maxSize:  4,
+			maxFiles: 2,
+			entries:  []string{"aaaaaaaa", "bb"},
+			files: map[string]string{
+				"audit.log":   "bb\n",
+				"audit.log.1": "aaaaaaaa\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "vsock-audit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "audit.log")
+
+			if test.existing != "" {
+				err = ioutil.WriteFile(path, []byte(test.existing), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sink, err := newAuditFileSink(path, test.maxSize, test.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, entry := range test.entries {
+				err = sink.Write([]byte(entry))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = sink.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files := map[string]string{}
+			for _, entry := range entries {
+				content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				files[entry.Name()] = string(content)
+			}
+
+			if !reflect.DeepEqual(files, test.files) {
+				t.Fatalf("Expected files %q, got %q", test.files, files)
+			}
+		})
+	}
+}
+
+func TestAuditFileSinkRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsock-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	err = ioutil.WriteFile(path+".1", []byte("old\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving audit.log.1 onto a non-empty directory fails
+	err = os.MkdirAll(filepath.Join(path+".2", "dir"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := newAuditFileSink(path, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range []string{"aaaa", "bbbb", "cccc"} {
+		err = sink.Write([]byte(entry))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{"audit.log": "aaaa\nbbbb\ncccc\n", "audit.log.1": "old\n"}
+	for name, expected := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(content) != expected {
+			t.Fatalf("Expected %q in %s, got %q", expected, name, content)
+		}
+	}
+
+	_, err = os.Stat(path + ".new")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected the new log file to be removed, got %v", err)
+	}
+}
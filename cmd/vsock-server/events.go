@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+var eventsLock sync.Mutex
+var eventListeners map[string]*eventListener = make(map[string]*eventListener)
+
+// eventTypes lists the event types listeners may subscribe to.
+var eventTypes = []string{"logging", "operation"}
+
+type eventListener struct {
+	project      string
+	connection   *websocket.Conn
+	messageTypes []string
+	active       chan bool
+	id           string
+	lock         sync.Mutex
+	done         bool
+}
+
+// close marks the listener as done and releases the websocket handler.
+func (l *eventListener) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.done {
+		return
+	}
+
+	l.done = true
+	close(l.active)
+}
+
+// send writes an event to the listener, closing it on failure.
+func (l *eventListener) send(body []byte) {
+	l.lock.Lock()
+
+	if l.done {
+		l.lock.Unlock()
+		return
+	}
+
+	l.connection.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err := l.connection.WriteMessage(websocket.TextMessage, body)
+	l.lock.Unlock()
+
+	if err != nil {
+		l.close()
+	}
+}
+
+type eventsServe struct {
+	req          *http.Request
+	messageTypes []string
+}
+
+func (r *eventsServe) Render(w http.ResponseWriter) error {
+	return eventsSocket(r.req, w, r.messageTypes)
+}
+
+func (r *eventsServe) String() string {
+	return "event handler"
+}
+
+func eventsSocket(r *http.Request, w http.ResponseWriter, messageTypes []string) error {
+	c, err := shared.WebsocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+
+	listener := &eventListener{
+		project:      projectParam(r),
+		connection:   c,
+		messageTypes: messageTypes,
+		active:       make(chan bool),
+		id:           uuid.NewRandom().String(),
+	}
+
+	eventsLock.Lock()
+	eventListeners[listener.id] = listener
+	eventsLock.Unlock()
+
+	log.Printf("New event listener: %s\n", listener.id)
+
+	// Detect the client going away, we don't expect any messages from it
+	go func() {
+		for {
+			_, _, err := c.NextReader()
+			if err != nil {
+				listener.close()
+				return
+			}
+		}
+	}()
+
+	<-listener.active
+
+	eventsLock.Lock()
+	delete(eventListeners, listener.id)
+	eventsLock.Unlock()
+
+	c.Close()
+	log.Printf("Disconnected event listener: %s\n", listener.id)
+
+	return nil
+}
+
+// eventsGet streams events of the requested types (all by default) over a
+// websocket.
+func eventsGet(w http.ResponseWriter, r *http.Request) Response {
+	messageTypes := eventTypes
+
+	typeStr := r.FormValue("type")
+	if typeStr != "" {
+		messageTypes = strings.Split(typeStr, ",")
+	}
+
+	for _, messageType := range messageTypes {
+		if !shared.StringInSlice(messageType, eventTypes) {
+			return BadRequest(fmt.Errorf("'%s' isn't a supported event type", messageType))
+		}
+	}
+
+	return &eventsServe{req: r, messageTypes: messageTypes}
+}
+
+// eventSend sends an event of the given type to all interested listeners.
+func eventSend(project string, eventType string, eventMessage interface{}) error {
+	encodedMessage, err := json.Marshal(eventMessage)
+	if err != nil {
+		return err
+	}
+
+	event := api.Event{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		Metadata:  encodedMessage,
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	eventsLock.Lock()
+	listeners := make([]*eventListener, 0, len(eventListeners))
+	for _, listener := range eventListeners {
+		if project != "" && listener.project != project {
+			continue
+		}
+
+		if !shared.StringInSlice(eventType, listener.messageTypes) {
+			continue
+		}
+
+		listeners = append(listeners, listener)
+	}
+	eventsLock.Unlock()
+
+	for _, listener := range listeners {
+		listener.send(body)
+	}
+
+	return nil
+}
+
+// eventLogWriter forwards the output of the standard logger to listeners of
+// logging events.
+type eventLogWriter struct{}
+
+func (eventLogWriter) Write(p []byte) (int, error) {
+	// Errors are ignored as logging them would recurse
+	eventSend("", "logging", api.EventLogging{
+		Level:   "info",
+		Message: strings.TrimSpace(string(p)),
+		Context: map[string]string{},
+	})
+
+	return len(p), nil
+}
@@ -3,21 +3,28 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 	lxdshared "github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/netutils"
+	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
+
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
 )
 
 type execWs struct {
@@ -34,9 +41,22 @@ type execWs struct {
 	fds              map[int]string
 	width            int
 	height           int
-	uid              uint32
-	gid              uint32
+	uid              *uint32
+	gid              *uint32
 	cwd              string
+	limits           vsockapi.InstanceExecLimits
+	detached         bool
+
+	// logFile receives the output of detached commands
+	logFile *os.File
+
+	// pid is the process group of the running command and reason the limit
+	// it exceeded, both guarded by pidLock
+	pid       int
+	reason    string
+	pidLock   sync.Mutex
+	cancelled chan bool
+	finished  chan bool
 }
 
 func (s *execWs) Metadata() interface{} {
@@ -54,6 +74,10 @@ func (s *execWs) Metadata() interface{} {
 		"command":     s.command,
 		"environment": s.env,
 		"interactive": s.interactive,
+		"detached":    s.detached,
+		"cwd":         s.cwd,
+		"user":        s.uid,
+		"group":       s.gid,
 	}
 }
 
@@ -99,8 +123,60 @@ func (s *execWs) Connect(op *operation, r *http.Request, w http.ResponseWriter)
 	return os.ErrPermission
 }
 
+// Cancel sends SIGTERM to the process group of the command, kills it if it's
+// still running after the cancel grace period and waits for Do to return.
+func (s *execWs) Cancel(op *operation) error {
+	s.pidLock.Lock()
+	close(s.cancelled)
+	pid := s.pid
+	s.pidLock.Unlock()
+
+	// The command was never started
+	if pid == 0 {
+		<-s.finished
+		return nil
+	}
+
+	err := unix.Kill(-pid, unix.SIGTERM)
+	if err != nil {
+		log.Printf("Failed to send SIGTERM to process group %d\n", pid)
+	}
+
+	select {
+	case <-s.finished:
+		return nil
+	case <-time.After(flagCancelGrace):
+	}
+
+	// The pid is cleared before the command is reaped, so it can't have been
+	// reused while it's still set
+	s.pidLock.Lock()
+	if s.pid == pid {
+		err = unix.Kill(-pid, unix.SIGKILL)
+		if err != nil {
+			log.Printf("Failed to send SIGKILL to process group %d\n", pid)
+		} else {
+			log.Printf("Sent SIGKILL to process group %d\n", pid)
+		}
+	}
+	s.pidLock.Unlock()
+
+	<-s.finished
+	return nil
+}
+
 func (s *execWs) Do(op *operation) error {
-	<-s.allConnected
+	defer close(s.finished)
+
+	if s.detached {
+		return s.doDetached(op)
+	}
+
+	select {
+	case <-s.allConnected:
+	case <-s.cancelled:
+		return fmt.Errorf("Cancelled before the command was started")
+	}
 
 	var err error
 	var ttys []*os.File
@@ -110,7 +186,18 @@ func (s *execWs) Do(op *operation) error {
 	var stdout *os.File
 	var stderr *os.File
 
+	var recorder *asciicastRecorder
+
 	if s.interactive {
+		// Interactive sessions are recorded before anything runs
+		if flagRecordingDir != "" {
+			recorder, err = newAsciicastRecorder(op.id, s.width, s.height, s.command, s.env)
+			if err != nil {
+				return errors.Wrap(err, "Failed to start recording")
+			}
+			defer recorder.Close()
+		}
+
 		ttys = make([]*os.File, 1)
 		ptys = make([]*os.File, 1)
 		ptys[0], ttys[0], err = lxdshared.OpenPty(s.rootUid, s.rootGid)
@@ -141,14 +228,12 @@ func (s *execWs) Do(op *operation) error {
 	}
 
 	controlExit := make(chan bool)
-	attachedChildIsBorn := make(chan int)
 	attachedChildIsDead := make(chan bool, 1)
 	var wgEOF sync.WaitGroup
 
 	if s.interactive {
 		wgEOF.Add(1)
 		go func() {
-			attachedChildPid := <-attachedChildIsBorn
 			select {
 			case <-s.controlConnected:
 				break
@@ -179,6 +264,11 @@ func (s *execWs) Do(op *operation) error {
 					}
 
 					// If an abnormal closure occurred, kill the attached process.
+					attachedChildPid := s.childPid()
+					if attachedChildPid == 0 {
+						return
+					}
+
 					err := unix.Kill(attachedChildPid, unix.SIGKILL)
 					if err != nil {
 						log.Printf("Failed to send SIGKILL to pid %d\n", attachedChildPid)
@@ -219,7 +309,20 @@ func (s *execWs) Do(op *operation) error {
 						log.Printf("Failed to set window size to: %dx%d\n", winchWidth, winchHeight)
 						continue
 					}
+
+					if recorder != nil {
+						err = recorder.Resize(winchWidth, winchHeight)
+						if err != nil {
+							log.Printf("Failed to record window size: %s\n", err)
+						}
+					}
 				} else if command.Command == "signal" {
+					attachedChildPid := s.childPid()
+					if attachedChildPid == 0 {
+						log.Printf("Not forwarding signal '%d', the command isn't running\n", command.Signal)
+						continue
+					}
+
 					if err := unix.Kill(attachedChildPid, unix.Signal(command.Signal)); err != nil {
 						log.Printf("Failed forwarding signal '%d' to PID %d\n", command.Signal, attachedChildPid)
 						continue
@@ -234,8 +337,15 @@ func (s *execWs) Do(op *operation) error {
 			conn := s.conns[0]
 			s.connsLock.Unlock()
 
+			var ptyReader io.ReadCloser = &metricsReader{ReadCloser: ptys[0], counter: metricsExecBytes["stdout"]}
+			if recorder != nil {
+				ptyReader = &recordingReader{ReadCloser: ptyReader, recorder: recorder}
+			}
+
+			ptyWriter := &metricsWriter{WriteCloser: ptys[0], counter: metricsExecBytes["stdin"]}
+
 			log.Println("Starting to mirror websocket")
-			readDone, writeDone := netutils.WebsocketExecMirror(conn, ptys[0], ptys[0], attachedChildIsDead, int(ptys[0].Fd()))
+			readDone, writeDone := netutils.WebsocketExecMirror(conn, ptyWriter, ptyReader, attachedChildIsDead, int(ptys[0].Fd()))
 
 			<-readDone
 			<-writeDone
@@ -254,14 +364,19 @@ func (s *execWs) Do(op *operation) error {
 					conn := s.conns[i]
 					s.connsLock.Unlock()
 
-					<-lxdshared.WebsocketRecvStream(ttys[i], conn)
+					<-lxdshared.WebsocketRecvStream(&metricsWriter{WriteCloser: ttys[i], counter: metricsExecBytes["stdin"]}, conn)
 					ttys[i].Close()
 				} else {
 					s.connsLock.Lock()
 					conn := s.conns[i]
 					s.connsLock.Unlock()
 
-					<-lxdshared.WebsocketSendStream(conn, ptys[i], -1)
+					stream := "stdout"
+					if i == 2 {
+						stream = "stderr"
+					}
+
+					<-lxdshared.WebsocketSendStream(conn, &metricsReader{ReadCloser: ptys[i], counter: metricsExecBytes[stream]}, -1)
 					ptys[i].Close()
 					wgEOF.Done()
 				}
@@ -294,18 +409,80 @@ func (s *execWs) Do(op *operation) error {
 			pty.Close()
 		}
 
-		metadata := lxdshared.Jmap{"return": cmdResult}
-		err = op.UpdateMetadata(metadata)
-		if err != nil {
-			return err
-		}
+		return s.finish(op, cmdResult, cmdErr)
+	}
+
+	return finisher(s.run(op, stdin, stdout, stderr))
+}
+
+// childPid returns the pid of the command or 0 if it wasn't started yet.
+func (s *execWs) childPid() int {
+	s.pidLock.Lock()
+	defer s.pidLock.Unlock()
 
-		return cmdErr
+	return s.pid
+}
+
+// doDetached runs the command without waiting for websockets, writing its
+// output to the log file of the operation.
+func (s *execWs) doDetached(op *operation) error {
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	defer s.logFile.Close()
+
+	cmdResult, cmdErr := s.run(op, stdin, s.logFile, s.logFile)
+
+	return s.finish(op, cmdResult, cmdErr)
+}
+
+// execLogPath returns the path of the log file of detached exec operation id.
+func execLogPath(id string) string {
+	return filepath.Join(flagLogDir, fmt.Sprintf("exec-%s.log", id))
+}
+
+// execLogCreate creates the log file of detached exec operation id.
+func execLogCreate(id string) (*os.File, error) {
+	err := os.MkdirAll(flagLogDir, 0700)
+	if err != nil {
+		return nil, err
 	}
 
+	return os.OpenFile(execLogPath(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+// finish records the exit status of the command in the operation metadata.
+func (s *execWs) finish(op *operation, cmdResult int, cmdErr error) error {
+	metadata := lxdshared.Jmap{"return": cmdResult}
+
+	s.pidLock.Lock()
+	if s.reason != "" {
+		metadata["reason"] = s.reason
+	}
+	s.pidLock.Unlock()
+
+	err := op.UpdateMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	return cmdErr
+}
+
+// run runs the command with the given standard streams and returns its exit
+// status.
+func (s *execWs) run(op *operation, stdin *os.File, stdout *os.File, stderr *os.File) (int, error) {
+	var err error
 	var cmd *exec.Cmd
 
-	if len(s.command) > 1 {
+	// Commands with limits are started through forkexec, which only runs
+	// them once their limits are in place
+	gated := execLimitsGated(s.limits)
+	if gated {
+		cmd = exec.Command("/proc/self/exe", append([]string{"forkexec", "--"}, s.command...)...)
+	} else if len(s.command) > 1 {
 		cmd = exec.Command(s.command[0], s.command[1:]...)
 	} else {
 		cmd = exec.Command(s.command[0])
@@ -320,34 +497,228 @@ func (s *execWs) Do(op *operation) error {
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 
+	// Run the command in its own process group so it can be cancelled as a whole
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Set the working directory
+	if s.cwd != "" {
+		fi, err := os.Stat(s.cwd)
+		if err != nil {
+			return -1, errors.Wrapf(err, "Invalid working directory %q", s.cwd)
+		}
+
+		if !fi.IsDir() {
+			return -1, fmt.Errorf("Invalid working directory %q: not a directory", s.cwd)
+		}
+
+		cmd.Dir = s.cwd
+	}
+
+	// Drop privileges if another user or group was requested, unset ones
+	// keep the credentials of the agent
+	uid, gid := execIDs(s.uid, s.gid)
+	if int(uid) != os.Getuid() || int(gid) != os.Getgid() {
+		credential, err := execCredential(uid, gid)
+		if err != nil {
+			return -1, err
+		}
+
+		cmd.SysProcAttr.Credential = credential
+	}
+
+	var gate *os.File
+	if gated {
+		var gateReader *os.File
+
+		gateReader, gate, err = os.Pipe()
+		if err != nil {
+			return -1, err
+		}
+		defer gateReader.Close()
+		defer gate.Close()
+
+		cmd.ExtraFiles = []*os.File{gateReader}
+	}
+
+	var cgroup string
+	if s.limits.Memory > 0 || s.limits.CPUs > 0 {
+		cgroup, err = execCgroupCreate(op.id, s.limits)
+		if err != nil {
+			return -1, errors.Wrap(err, "Failed to create cgroup")
+		}
+		defer execCgroupDelete(cgroup)
+	}
+
+	s.pidLock.Lock()
+	select {
+	case <-s.cancelled:
+		s.pidLock.Unlock()
+		return -1, fmt.Errorf("Cancelled before the command was started")
+	default:
+	}
+
 	err = cmd.Start()
 	if err != nil {
-		return finisher(-1, err)
+		s.pidLock.Unlock()
+		return -1, err
+	}
+
+	s.pid = cmd.Process.Pid
+	s.pidLock.Unlock()
+
+	start := time.Now()
+
+	if gated {
+		err = execRlimits(cmd.Process.Pid, s.limits)
+		if err == nil && cgroup != "" {
+			err = execCgroupAdd(cgroup, cmd.Process.Pid)
+		}
+
+		if err != nil {
+			cmd.Process.Kill()
+			s.wait(cmd)
+			return -1, errors.Wrap(err, "Failed to apply limits")
+		}
+
+		// Let forkexec run the command
+		gate.Close()
 	}
 
-	err = cmd.Wait()
+	var timer *time.Timer
+	if s.limits.Timeout > 0 {
+		timer = time.AfterFunc(time.Duration(s.limits.Timeout)*time.Second, func() {
+			s.pidLock.Lock()
+			defer s.pidLock.Unlock()
+
+			// The command exited in the meantime
+			if s.pid == 0 {
+				return
+			}
+
+			err := unix.Kill(-s.pid, unix.SIGKILL)
+			if err != nil {
+				log.Printf("Failed to send SIGKILL to process group %d\n", s.pid)
+			}
+		})
+	}
+
+	err = s.wait(cmd)
+	metricsExecObserve(time.Since(start))
+
+	// The command only timed out if the timer fired before it could be stopped
+	timedOut := timer != nil && !timer.Stop()
+
+	s.pidLock.Lock()
+	if s.reason == "" {
+		if timedOut {
+			s.reason = execReasonTimeout
+		} else if execCPUTimeExceeded(cmd.ProcessState, s.limits) {
+			s.reason = execReasonCPUTime
+		} else if cgroup != "" && execCgroupOOMKilled(cgroup) {
+			s.reason = execReasonMemory
+		}
+	}
+	s.pidLock.Unlock()
+
 	if err == nil {
-		return finisher(0, nil)
+		return 0, nil
 	}
 
 	exitErr, ok := err.(*exec.ExitError)
 	if ok {
 		status, ok := exitErr.Sys().(syscall.WaitStatus)
 		if ok {
-			return finisher(status.ExitStatus(), nil)
+			if status.Signaled() {
+				// 128 + n == Fatal error signal "n"
+				return 128 + int(status.Signal()), nil
+			}
+
+			return status.ExitStatus(), nil
+		}
+	}
+
+	return -1, nil
+}
+
+// wait waits for cmd to exit and clears the pid before reaping it. Signals
+// sent to the pid under pidLock thus can't reach a process that reused it.
+func (s *execWs) wait(cmd *exec.Cmd) error {
+	// Leave the command a zombie so that its pid stays taken
+	for {
+		var info unix.Siginfo
+
+		err := unix.Waitid(unix.P_PID, cmd.Process.Pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if err != unix.EINTR {
+			break
+		}
+	}
+
+	s.pidLock.Lock()
+	s.pid = 0
+	s.pidLock.Unlock()
+
+	return cmd.Wait()
+}
+
+// execIDs returns the user and group ID a command is run as, the ones of the
+// agent if unset.
+func execIDs(uid *uint32, gid *uint32) (uint32, uint32) {
+	runUid := uint32(os.Getuid())
+	if uid != nil {
+		runUid = *uid
+	}
+
+	runGid := uint32(os.Getgid())
+	if gid != nil {
+		runGid = *gid
+	}
+
+	return runUid, runGid
+}
+
+// execCredential returns the credential for running a command as uid and gid,
+// including the supplementary groups of the matching user from /etc/group.
+func execCredential(uid uint32, gid uint32) (*syscall.Credential, error) {
+	credential := &syscall.Credential{
+		Uid:    uid,
+		Gid:    gid,
+		Groups: []uint32{},
+	}
+
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		// Users without a passwd entry simply get no supplementary groups
+		_, ok := err.(user.UnknownUserIdError)
+		if ok {
+			return credential, nil
+		}
+
+		return nil, errors.Wrapf(err, "Failed to look up user %d", uid)
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to look up groups of user %q", u.Username)
+	}
+
+	for _, groupID := range groupIDs {
+		id, err := strconv.ParseUint(groupID, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid group ID %q for user %q", groupID, u.Username)
 		}
 
-		if status.Signaled() {
-			// 128 + n == Fatal error signal "n"
-			return finisher(128+int(status.Signal()), nil)
+		if uint32(id) == gid {
+			continue
 		}
+
+		credential.Groups = append(credential.Groups, uint32(id))
 	}
 
-	return finisher(-1, nil)
+	return credential, nil
 }
 
 func execHandler(w http.ResponseWriter, r *http.Request) Response {
-	post := api.ContainerExecPost{}
+	post := vsockapi.InstanceExecPost{}
 
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -358,6 +729,15 @@ func execHandler(w http.ResponseWriter, r *http.Request) Response {
 		return BadRequest(err)
 	}
 
+	err = execLimitsValidate(post.Limits)
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	if post.Detached && post.Interactive {
+		return BadRequest(fmt.Errorf("Detached commands can't be interactive"))
+	}
+
 	env := map[string]string{}
 
 	if post.Environment != nil {
@@ -372,7 +752,8 @@ func execHandler(w http.ResponseWriter, r *http.Request) Response {
 	}
 
 	// If running as root, set some env variables
-	if post.User == 0 {
+	uid, _ := execIDs(post.User, post.Group)
+	if uid == 0 {
 		// Set default value for HOME
 		_, ok = env["HOME"]
 		if !ok {
@@ -396,19 +777,27 @@ func execHandler(w http.ResponseWriter, r *http.Request) Response {
 	ws.fds = map[int]string{}
 
 	ws.conns = map[int]*websocket.Conn{}
-	ws.conns[-1] = nil
-	ws.conns[0] = nil
-	if !post.Interactive {
-		ws.conns[1] = nil
-		ws.conns[2] = nil
-	}
 	ws.allConnected = make(chan bool, 1)
 	ws.controlConnected = make(chan bool, 1)
+	ws.cancelled = make(chan bool)
+	ws.finished = make(chan bool)
 	ws.interactive = post.Interactive
-	for i := -1; i < len(ws.conns)-1; i++ {
-		ws.fds[i], err = lxdshared.RandomCryptoString()
-		if err != nil {
-			return InternalError(err)
+	ws.detached = post.Detached
+
+	// Detached commands don't use websockets
+	if !ws.detached {
+		ws.conns[-1] = nil
+		ws.conns[0] = nil
+		if !post.Interactive {
+			ws.conns[1] = nil
+			ws.conns[2] = nil
+		}
+
+		for i := -1; i < len(ws.conns)-1; i++ {
+			ws.fds[i], err = lxdshared.RandomCryptoString()
+			if err != nil {
+				return InternalError(err)
+			}
 		}
 	}
 
@@ -421,13 +810,48 @@ func execHandler(w http.ResponseWriter, r *http.Request) Response {
 	ws.cwd = post.Cwd
 	ws.uid = post.User
 	ws.gid = post.Group
+	ws.limits = post.Limits
 
 	resources := map[string][]string{}
 
-	op, err := operationCreate("default", operationClassWebsocket, resources, ws.Metadata(), ws.Do, nil, ws.Connect)
+	var op *operation
+	if ws.detached {
+		// Keep detached operations and their logs around for later
+		// retrieval. The log is created before the operation is published so
+		// it can be retrieved as soon as the operation exists.
+		id := uuid.NewRandom().String()
+
+		ws.logFile, err = execLogCreate(id)
+		if err != nil {
+			return InternalError(errors.Wrap(err, "Failed to create the command log"))
+		}
+
+		op, err = operationCreateWithID(id, "default", operationClassTask, resources, ws.Metadata(), ws.Do, ws.Cancel, nil, r)
+		if err != nil {
+			ws.logFile.Close()
+			os.Remove(execLogPath(id))
+		}
+	} else {
+		op, err = operationCreate("default", operationClassWebsocket, resources, ws.Metadata(), ws.Do, ws.Cancel, ws.Connect, r)
+	}
+
+	if err == errShuttingDown {
+		return Unavailable(err)
+	}
+
 	if err != nil {
 		return InternalError(errors.Wrap(err, "OperationCreate"))
 	}
 
+	if ws.detached {
+		op.retention = flagLogRetention
+		op.onDelete = func(op *operation) {
+			err := os.Remove(execLogPath(op.id))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove log of Operation: %s: %s\n", op.id, err)
+			}
+		}
+	}
+
 	return OperationResponse(op)
 }
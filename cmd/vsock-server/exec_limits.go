@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
+)
+
+// Reasons reported in the operation metadata when a command hit a limit
+const (
+	execReasonTimeout = "timeout"
+	execReasonCPUTime = "cpu_time"
+	execReasonMemory  = "memory"
+)
+
+// cpuMaxPeriod is the cpu.max period in microseconds.
+const cpuMaxPeriod = 100000
+
+// execLimitsValidate checks that limits make sense and can be applied.
+func execLimitsValidate(limits vsockapi.InstanceExecLimits) error {
+	if limits.Timeout < 0 || limits.Memory < 0 || limits.CPUs < 0 {
+		return fmt.Errorf("Limits can't be negative")
+	}
+
+	if limits.Memory > 0 || limits.CPUs > 0 {
+		_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+		if err != nil {
+			return fmt.Errorf("Memory and CPU limits require cgroup v2")
+		}
+	}
+
+	return nil
+}
+
+// execLimitsGated returns whether the command needs to be started through
+// forkexec, so that its limits are in place before it runs.
+func execLimitsGated(limits vsockapi.InstanceExecLimits) bool {
+	return limits.CPUTime > 0 || limits.Files > 0 || limits.AddressSpace > 0 || limits.Processes > 0 || limits.Memory > 0 || limits.CPUs > 0
+}
+
+// forkexec is run as "vsock-server forkexec -- command [args...]". It waits
+// for the agent to close file descriptor 3 once the limits of the process
+// are in place and then replaces itself with the command.
+func forkexec(args []string) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Missing command")
+		os.Exit(1)
+	}
+
+	gate := os.NewFile(3, "gate")
+	ioutil.ReadAll(gate)
+	gate.Close()
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(127)
+	}
+
+	err = unix.Exec(path, args, os.Environ())
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(126)
+}
+
+// execRlimits sets the resource limits of the process pid.
+func execRlimits(pid int, limits vsockapi.InstanceExecLimits) error {
+	rlimits := map[int]uint64{
+		unix.RLIMIT_CPU:    limits.CPUTime,
+		unix.RLIMIT_NOFILE: limits.Files,
+		unix.RLIMIT_AS:     limits.AddressSpace,
+		unix.RLIMIT_NPROC:  limits.Processes,
+	}
+
+	for resource, value := range rlimits {
+		if value == 0 {
+			continue
+		}
+
+		rlimit := unix.Rlimit{Cur: value, Max: value}
+
+		// Send SIGXCPU at the limit and only SIGKILL a second later
+		if resource == unix.RLIMIT_CPU {
+			rlimit.Max++
+		}
+
+		err := unix.Prlimit(pid, resource, &rlimit, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to set resource limit %d: %v", resource, err)
+		}
+	}
+
+	return nil
+}
+
+// execCPUTimeExceeded returns whether the command was killed for exceeding
+// its CPU time limit.
+func execCPUTimeExceeded(state *os.ProcessState, limits vsockapi.InstanceExecLimits) bool {
+	if limits.CPUTime == 0 || state == nil {
+		return false
+	}
+
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+
+	if status.Signal() == unix.SIGXCPU {
+		return true
+	}
+
+	return status.Signal() == unix.SIGKILL && state.UserTime()+state.SystemTime() >= time.Duration(limits.CPUTime)*time.Second
+}
+
+var execCgroupLock sync.Mutex
+var execCgroupParentPath string
+
+// execCgroupParent returns the cgroup under which the transient cgroups of
+// commands are created. As cgroup v2 only allows enabling controllers for the
+// children of cgroups without processes, the agent first moves itself into a
+// leaf cgroup unless it runs in the root cgroup. Under systemd this changes
+// the cgroup of the agent's service, which is only safe with Delegate=yes.
+func execCgroupParent() (string, error) {
+	execCgroupLock.Lock()
+	defer execCgroupLock.Unlock()
+
+	if execCgroupParentPath != "" {
+		return execCgroupParentPath, nil
+	}
+
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	own := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			own = strings.TrimPrefix(line, "0::")
+			break
+		}
+	}
+
+	if own == "" {
+		return "", fmt.Errorf("Failed to find the cgroup of the agent")
+	}
+
+	parent := filepath.Join("/sys/fs/cgroup", own)
+
+	if own != "/" {
+		leaf := filepath.Join(parent, "agent")
+
+		err = os.Mkdir(leaf, 0755)
+		if err != nil && !os.IsExist(err) {
+			return "", err
+		}
+
+		err = ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+		if err != nil {
+			return "", fmt.Errorf("Failed to move the agent to cgroup %q: %v", leaf, err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+	if err != nil {
+		return "", fmt.Errorf("Failed to enable the memory and cpu controllers in cgroup %q: %v", parent, err)
+	}
+
+	execCgroupParentPath = parent
+
+	return parent, nil
+}
+
+// execCgroupCreate creates the transient cgroup of operation id with the
+// memory and CPU limits applied.
+func execCgroupCreate(id string, limits vsockapi.InstanceExecLimits) (string, error) {
+	parent, err := execCgroupParent()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(parent, fmt.Sprintf("exec-%s", id))
+
+	err = os.Mkdir(path, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	if limits.Memory > 0 {
+		err = ioutil.WriteFile(filepath.Join(path, "memory.max"), []byte(strconv.FormatInt(limits.Memory, 10)), 0644)
+		if err != nil {
+			execCgroupDelete(path)
+			return "", err
+		}
+	}
+
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cpuMaxPeriod)
+		err = ioutil.WriteFile(filepath.Join(path, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, cpuMaxPeriod)), 0644)
+		if err != nil {
+			execCgroupDelete(path)
+			return "", err
+		}
+	}
+
+	return path, nil
+}
+
+// execCgroupAdd moves the process pid into the cgroup path.
+func execCgroupAdd(path string, pid int) error {
+	return ioutil.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// execCgroupOOMKilled returns whether a process of the cgroup path was killed
+// for exceeding memory.max.
+func execCgroupOOMKilled(path string) bool {
+	f, err := os.Open(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return fields[1] != "0"
+		}
+	}
+
+	return false
+}
+
+// execCgroupDelete kills the processes left in the cgroup path and removes it.
+func execCgroupDelete(path string) error {
+	// cgroup.kill only exists as of Linux 5.14
+	ioutil.WriteFile(filepath.Join(path, "cgroup.kill"), []byte("1"), 0644)
+
+	var err error
+	for i := 0; i < 10; i++ {
+		err = os.Remove(path)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return err
+}
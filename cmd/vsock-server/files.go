@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/pkg/errors"
+
+	vsockshared "github.com/monstermunchkin/vsock/shared"
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
+)
+
+// fileParam returns the absolute path given in the path query parameter.
+func fileParam(r *http.Request) (string, error) {
+	path := r.FormValue("path")
+	if path == "" {
+		return "", fmt.Errorf("Missing path argument")
+	}
+
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("Path %q isn't absolute", path)
+	}
+
+	return filepath.Clean(path), nil
+}
+
+// fileType returns the type of a file as used in the X-LXD-type header.
+func fileType(fi os.FileInfo) string {
+	switch {
+	case fi.Mode().IsRegular():
+		return "file"
+	case fi.IsDir():
+		return "directory"
+	case fi.Mode()&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// fileHeaders returns the X-LXD-* headers describing the ownership, mode and
+// type of a file.
+func fileHeaders(fi os.FileInfo, type_ string) map[string]string {
+	headers := map[string]string{
+		"X-LXD-mode": fmt.Sprintf("%04o", fi.Mode().Perm()),
+		"X-LXD-type": type_,
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok {
+		headers["X-LXD-mode"] = fmt.Sprintf("%04o", st.Mode&07777)
+		headers["X-LXD-uid"] = fmt.Sprintf("%d", st.Uid)
+		headers["X-LXD-gid"] = fmt.Sprintf("%d", st.Gid)
+	}
+
+	return headers
+}
+
+// fileGet returns the content of a file, or the entries of a directory, with
+// its ownership and mode in the response headers.
+func fileGet(w http.ResponseWriter, r *http.Request) Response {
+	path, err := fileParam(r)
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	switch fileType(fi) {
+	case "file":
+		files := []fileResponseEntry{{
+			identifier: filepath.Base(path),
+			path:       path,
+			filename:   filepath.Base(path),
+		}}
+
+		return FileResponse(r, files, fileHeaders(fi, "file"), false)
+	case "directory":
+		entries, err := fileEntries(path)
+		if err != nil {
+			return SmartError(err)
+		}
+
+		return SyncResponseHeaders(true, entries, fileHeaders(fi, "directory"))
+	default:
+		return BadRequest(fmt.Errorf("Path %q is neither a regular file nor a directory", path))
+	}
+}
+
+// fileEntries lists the content of a directory.
+func fileEntries(path string) ([]vsockapi.InstanceFileEntry, error) {
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []vsockapi.InstanceFileEntry{}
+
+	for _, fi := range fis {
+		entry := vsockapi.InstanceFileEntry{
+			Name:    fi.Name(),
+			Type:    fileType(fi),
+			Mode:    int(fi.Mode().Perm()),
+			UID:     -1,
+			GID:     -1,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if ok {
+			entry.Mode = int(st.Mode & 07777)
+			entry.UID = int64(st.Uid)
+			entry.GID = int64(st.Gid)
+		}
+
+		if entry.Type == "symlink" {
+			entry.Target, err = os.Readlink(filepath.Join(path, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// filePost creates a file, directory or symlink. Files are written from the
+// request body, either replacing or appending to their content, symlinks point
+// to the path given in the body. The ownership and mode given in the headers
+// are applied to the result.
+func filePost(w http.ResponseWriter, r *http.Request) Response {
+	path, err := fileParam(r)
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	uid, gid, mode, type_, write := shared.ParseLXDFileHeaders(r.Header)
+
+	switch type_ {
+	case "file":
+		return fileCreate(path, r.Body, uid, gid, mode, write)
+	case "directory":
+		return fileCreateDirectory(path, uid, gid, mode)
+	case "symlink":
+		return fileCreateSymlink(path, r.Body, uid, gid)
+	default:
+		return BadRequest(fmt.Errorf("Bad file type: %s", type_))
+	}
+}
+
+func fileCreate(path string, content io.Reader, uid int64, gid int64, mode int, write string) Response {
+	flags := os.O_WRONLY | os.O_CREATE
+	switch write {
+	case "overwrite":
+		flags |= os.O_TRUNC
+	case "append":
+		flags |= os.O_APPEND
+	default:
+		return BadRequest(fmt.Errorf("Bad file write mode: %s", write))
+	}
+
+	fi, err := os.Stat(path)
+	if err == nil && !fi.Mode().IsRegular() {
+		return BadRequest(fmt.Errorf("Path %q isn't a regular file", path))
+	}
+
+	createMode := os.FileMode(0644)
+	if mode > -1 {
+		createMode = os.FileMode(mode)
+	}
+
+	f, err := os.OpenFile(path, flags, createMode)
+	if err != nil {
+		return SmartError(err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, content)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	// Ownership is changed first as chown clears the setuid and setgid bits
+	if uid > -1 || gid > -1 {
+		err = f.Chown(int(uid), int(gid))
+		if err != nil {
+			return InternalError(err)
+		}
+	}
+
+	// The mode passed to OpenFile only applies to new files and is subject to
+	// the umask.
+	if mode > -1 {
+		err = f.Chmod(os.FileMode(mode))
+		if err != nil {
+			return InternalError(err)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+func fileCreateDirectory(path string, uid int64, gid int64, mode int) Response {
+	createMode := os.FileMode(0755)
+	if mode > -1 {
+		createMode = os.FileMode(mode)
+	}
+
+	// Existing directories only get their mode and ownership updated
+	err := os.Mkdir(path, createMode)
+	if err != nil && !os.IsExist(err) {
+		return SmartError(err)
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if !fi.IsDir() {
+		return BadRequest(fmt.Errorf("Path %q exists and isn't a directory", path))
+	}
+
+	if uid > -1 || gid > -1 {
+		err = os.Chown(path, int(uid), int(gid))
+		if err != nil {
+			return InternalError(err)
+		}
+	}
+
+	if mode > -1 {
+		err = os.Chmod(path, os.FileMode(mode))
+		if err != nil {
+			return InternalError(err)
+		}
+	}
+
+	return EmptySyncResponse
+}
+
+func fileCreateSymlink(path string, content io.Reader, uid int64, gid int64) Response {
+	target, err := ioutil.ReadAll(content)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	if len(target) == 0 {
+		return BadRequest(fmt.Errorf("Missing symlink target"))
+	}
+
+	err = os.Symlink(string(target), path)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if uid > -1 || gid > -1 {
+		err = os.Lchown(path, int(uid), int(gid))
+		if err != nil {
+			return InternalError(err)
+		}
+	}
+
+	return EmptySyncResponse
+}
+
+// fileDelete removes a file, symlink or empty directory.
+func fileDelete(w http.ResponseWriter, r *http.Request) Response {
+	path, err := fileParam(r)
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	if path == "/" {
+		return BadRequest(fmt.Errorf("Refusing to remove /"))
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	return EmptySyncResponse
+}
+
+// fileArchiveTar runs tar with the given arguments, wrapping failures with
+// what tar printed on stderr.
+func fileArchiveTar(stdin io.Reader, stdout io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("tar", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to run tar: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// fileArchiveGet streams a directory tree as a tar archive. The archive
+// contains the directory itself, not only its content.
+func fileArchiveGet(w http.ResponseWriter, r *http.Request) Response {
+	path, err := fileParam(r)
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	compressionArgs, err := vsockshared.TarCompressionArgs(r.FormValue("compression"))
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	if !fi.IsDir() {
+		return BadRequest(fmt.Errorf("Path %q isn't a directory", path))
+	}
+
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	if path == "/" {
+		base = "."
+	}
+
+	args := append([]string{}, vsockshared.TarCreateArgs...)
+	args = append(args, compressionArgs...)
+	args = append(args, "--directory", dir, base)
+
+	headers := fileHeaders(fi, "directory")
+	headers["Content-Type"] = "application/x-tar"
+
+	return StreamResponse(headers, func(w io.Writer) error {
+		return fileArchiveTar(nil, w, args...)
+	})
+}
+
+// fileArchivePost extracts the tar archive in the request body into a
+// directory, creating it if needed.
+func fileArchivePost(w http.ResponseWriter, r *http.Request) Response {
+	path, err := fileParam(r)
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	compressionArgs, err := vsockshared.TarCompressionArgs(r.FormValue("compression"))
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return SmartError(err)
+	}
+
+	args := append([]string{}, vsockshared.TarExtractArgs...)
+	args = append(args, compressionArgs...)
+	args = append(args, "--directory", path)
+
+	err = fileArchiveTar(r.Body, nil, args...)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	return EmptySyncResponse
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/vsock"
+)
+
+// listenAddresses are the URIs of the addresses the agent listens on.
+var listenAddresses []string
+
+// listenVsockCID is the context ID of the guest, 0 if the agent doesn't
+// listen on vsock.
+var listenVsockCID uint32
+
+// listenFlag collects repeated -listen URIs.
+type listenFlag []string
+
+func (f *listenFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listenFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// listen creates a listener for a vsock://:PORT, unix:///PATH or
+// tcp://HOST:PORT URI.
+func listen(uri string) (net.Listener, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "vsock":
+		if u.Hostname() != "" {
+			return nil, fmt.Errorf("Invalid listen address %q: vsock listeners can't have a context ID", uri)
+		}
+
+		port, err := strconv.ParseUint(u.Port(), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid listen address %q: bad port", uri)
+		}
+
+		return vsock.Listen(uint32(port))
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("Invalid listen address %q: missing path", uri)
+		}
+
+		// Remove a stale socket left behind by a previous run
+		fi, err := os.Lstat(u.Path)
+		if err == nil && fi.Mode()&os.ModeSocket != 0 {
+			err = os.Remove(u.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return net.Listen("unix", u.Path)
+	case "tcp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("Invalid listen address %q: missing port", uri)
+		}
+
+		return net.Listen("tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("Invalid listen address %q: unsupported scheme %q", uri, u.Scheme)
+	}
+}
+
+// listenerURI returns the URI of the address l listens on.
+func listenerURI(l net.Listener) string {
+	switch addr := l.Addr().(type) {
+	case *vsock.Addr:
+		return fmt.Sprintf("vsock://:%d", addr.Port)
+	case *net.UnixAddr:
+		return fmt.Sprintf("unix://%s", addr.Name)
+	case *net.TCPAddr:
+		return fmt.Sprintf("tcp://%s", addr.String())
+	}
+
+	return l.Addr().String()
+}
+
+// vsockPort returns the port of the first vsock listen address, or 0 if the
+// agent doesn't listen on vsock.
+func vsockPort(uris []string) uint32 {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "vsock" {
+			continue
+		}
+
+		port, err := strconv.ParseUint(u.Port(), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		return uint32(port)
+	}
+
+	return 0
+}
+
+// vsockContextID returns the context ID of the guest, or 0 if the agent
+// doesn't listen on vsock.
+func vsockContextID(uris []string) uint32 {
+	if vsockPort(uris) == 0 {
+		return 0
+	}
+
+	cid, err := vsock.ContextID()
+	if err != nil {
+		log.Printf("Failed to get vsock context ID: %v\n", err)
+		return 0
+	}
+
+	return cid
+}
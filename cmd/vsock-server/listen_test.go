@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsock-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+
+	tests := []struct {
+		name string
+		uri  string
+		err  bool
+	}{
+		{"unix", "unix://" + socket, false},
+		{"stale unix socket", "unix://" + socket, false},
+		{"tcp", "tcp://127.0.0.1:0", false},
+		{"vsock with context ID", "vsock://3:8443", true},
+		{"vsock without port", "vsock://", true},
+		{"vsock with bad port", "vsock://:port", true},
+		{"unix without path", "unix://", true},
+		{"tcp without port", "tcp://127.0.0.1", true},
+		{"unsupported scheme", "udp://127.0.0.1:8443", true},
+		{"invalid URI", "tcp://[::1", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := listen(test.uri)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if l == nil {
+				return
+			}
+
+			// Leave the socket behind for the stale socket case
+			unixListener, ok := l.(*net.UnixListener)
+			if ok {
+				unixListener.SetUnlinkOnClose(false)
+			}
+
+			l.Close()
+		})
+	}
+}
+
+func TestListenerURI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsock-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	tests := []struct {
+		name     string
+		l        net.Listener
+		expected string
+	}{
+		{"unix", unixListener, "unix://" + socket},
+		{"tcp", tcpListener, fmt.Sprintf("tcp://127.0.0.1:%d", tcpListener.Addr().(*net.TCPAddr).Port)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uri := listenerURI(test.l)
+			if uri != test.expected {
+				t.Fatalf("Expected %q, got %q", test.expected, uri)
+			}
+		})
+	}
+}
+
+func TestVsockPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		uris     []string
+		expected uint32
+	}{
+		{"none", nil, 0},
+		{"vsock", []string{"vsock://:8443"}, 8443},
+		{"first vsock", []string{"unix:///run/vsock.sock", "vsock://:1024", "vsock://:2048"}, 1024},
+		{"no vsock", []string{"unix:///run/vsock.sock", "tcp://127.0.0.1:8443"}, 0},
+		{"bad port", []string{"vsock://:port", "vsock://:8443"}, 8443},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port := vsockPort(test.uris)
+			if port != test.expected {
+				t.Fatalf("Expected %d, got %d", test.expected, port)
+			}
+		})
+	}
+}
@@ -19,6 +19,11 @@ import (
 var operationsLock sync.Mutex
 var operations map[string]*operation = make(map[string]*operation)
 
+// operationsClosed is set once the agent shuts down, refusing new operations
+var operationsClosed bool
+
+var errShuttingDown = fmt.Errorf("The agent is shutting down")
+
 type operationClass int
 
 const (
@@ -51,10 +56,20 @@ type operation struct {
 	description string
 	permission  string
 
+	// How long the operation is kept once done, 5 seconds if unset
+	retention time.Duration
+
+	// The client that created the operation and the last status written to
+	// the audit log
+	requestor   *auditRequestor
+	auditStatus api.StatusCode
+	auditLock   sync.Mutex
+
 	// Those functions are called at various points in the Operation lifecycle
 	onRun     func(*operation) error
 	onCancel  func(*operation) error
 	onConnect func(*operation, *http.Request, http.ResponseWriter) error
+	onDelete  func(*operation)
 
 	// Channels used for error reporting and state tracking of background actions
 	chanDone chan error
@@ -63,20 +78,29 @@ type operation struct {
 	lock sync.Mutex
 }
 
+// done marks the operation as finished. It may be called more than once, only
+// the first call has an effect.
 func (op *operation) done() {
+	op.lock.Lock()
 	if op.readonly {
+		op.lock.Unlock()
 		return
 	}
 
-	op.lock.Lock()
 	op.readonly = true
 	op.onRun = nil
 	op.onCancel = nil
 	op.onConnect = nil
 	close(op.chanDone)
+	metricsOperationDone(op)
 	op.lock.Unlock()
 
-	time.AfterFunc(time.Second*5, func() {
+	retention := op.retention
+	if retention == 0 {
+		retention = time.Second * 5
+	}
+
+	time.AfterFunc(retention, func() {
 		operationsLock.Lock()
 		_, ok := operations[op.id]
 		if !ok {
@@ -86,6 +110,10 @@ func (op *operation) done() {
 
 		delete(operations, op.id)
 		operationsLock.Unlock()
+
+		if op.onDelete != nil {
+			op.onDelete(op)
+		}
 	})
 }
 
@@ -102,8 +130,18 @@ func (op *operation) Run() (chan error, error) {
 	if op.onRun != nil {
 		go func(op *operation, chanRun chan error) {
 			err := op.onRun(op)
+
+			// Cancel() finishes the operation once onCancel returns. The
+			// status is checked and changed at once so a concurrent Cancel()
+			// either sees the final status or is seen here.
+			op.lock.Lock()
+			if op.status == api.Cancelling {
+				op.lock.Unlock()
+				chanRun <- err
+				return
+			}
+
 			if err != nil {
-				op.lock.Lock()
 				op.status = api.Failure
 				op.err = SmartError(err).String()
 				op.lock.Unlock()
@@ -112,11 +150,10 @@ func (op *operation) Run() (chan error, error) {
 
 				log.Printf("Failure for %s Operation: %s: %s\n", op.class.String(), op.id, err)
 
-				op.Render()
+				op.sendEvent()
 				return
 			}
 
-			op.lock.Lock()
 			op.status = api.Success
 			op.lock.Unlock()
 			op.done()
@@ -124,34 +161,37 @@ func (op *operation) Run() (chan error, error) {
 
 			op.lock.Lock()
 			log.Printf("Success for %s Operation: %s\n", op.class.String(), op.id)
-			op.Render()
+			op.sendEvent()
 			op.lock.Unlock()
 		}(op, chanRun)
 	}
 	op.lock.Unlock()
 
 	log.Printf("Started %s Operation: %s\n", op.class.String(), op.id)
-	op.Render()
+	op.sendEvent()
 
 	return chanRun, nil
 }
 
 func (op *operation) Cancel() (chan error, error) {
+	// Operations finishing concurrently can't be cancelled anymore
+	op.lock.Lock()
 	if op.status != api.Running {
+		op.lock.Unlock()
 		return nil, fmt.Errorf("Only running operations can be cancelled")
 	}
 
 	if !op.mayCancel() {
+		op.lock.Unlock()
 		return nil, fmt.Errorf("This Operation can't be cancelled")
 	}
 
-	chanCancel := make(chan error, 1)
-
-	op.lock.Lock()
 	oldStatus := op.status
 	op.status = api.Cancelling
 	op.lock.Unlock()
 
+	chanCancel := make(chan error, 1)
+
 	if op.onCancel != nil {
 		go func(op *operation, oldStatus api.StatusCode, chanCancel chan error) {
 			err := op.onCancel(op)
@@ -162,7 +202,7 @@ func (op *operation) Cancel() (chan error, error) {
 				chanCancel <- err
 
 				log.Printf("Failed to cancel %s Operation: %s: %s\n", op.class.String(), op.id, err)
-				op.Render()
+				op.sendEvent()
 				return
 			}
 
@@ -173,12 +213,12 @@ func (op *operation) Cancel() (chan error, error) {
 			chanCancel <- nil
 
 			log.Printf("Cancelled %s Operation: %s\n", op.class.String(), op.id)
-			op.Render()
+			op.sendEvent()
 		}(op, oldStatus, chanCancel)
 	}
 
 	log.Printf("Cancelling %s Operation: %s\n", op.class.String(), op.id)
-	op.Render()
+	op.sendEvent()
 
 	if op.canceler != nil {
 		err := op.canceler.Cancel()
@@ -196,7 +236,7 @@ func (op *operation) Cancel() (chan error, error) {
 	}
 
 	log.Printf("Cancelled %s Operation: %s\n", op.class.String(), op.id)
-	op.Render()
+	op.sendEvent()
 
 	return chanCancel, nil
 }
@@ -280,6 +320,18 @@ func (op *operation) Render() (string, *api.Operation, error) {
 	}, nil
 }
 
+// sendEvent notifies event listeners of the current state of the operation.
+func (op *operation) sendEvent() {
+	_, md, err := op.Render()
+	if err != nil {
+		log.Printf("Failed to render %s Operation: %s: %s\n", op.class.String(), op.id, err)
+		return
+	}
+
+	auditOperation(op, md)
+	eventSend(op.project, "operation", md)
+}
+
 func (op *operation) WaitFinal(timeout int) (bool, error) {
 	// Check current state
 	if op.status.IsFinal() {
@@ -322,14 +374,14 @@ func (op *operation) UpdateResources(opResources map[string][]string) error {
 	op.lock.Unlock()
 
 	log.Printf("Updated resources for %s Operation: %s\n", op.class.String(), op.id)
-	op.Render()
+	op.sendEvent()
 
 	return nil
 }
 
 func (op *operation) UpdateMetadata(opMetadata interface{}) error {
-	if op.status != api.Pending && op.status != api.Running {
-		return fmt.Errorf("Only pending or running operations can be updated")
+	if op.status != api.Pending && op.status != api.Running && op.status != api.Cancelling {
+		return fmt.Errorf("Only pending, running or cancelling operations can be updated")
 	}
 
 	if op.readonly {
@@ -347,16 +399,23 @@ func (op *operation) UpdateMetadata(opMetadata interface{}) error {
 	op.lock.Unlock()
 
 	log.Printf("Updated metadata for %s Operation: %s\n", op.class.String(), op.id)
-	op.Render()
+	op.sendEvent()
 
 	return nil
 }
 
-func operationCreate(project string, opClass operationClass, opResources map[string][]string, opMetadata interface{}, onRun func(*operation) error, onCancel func(*operation) error, onConnect func(*operation, *http.Request, http.ResponseWriter) error) (*operation, error) {
+func operationCreate(project string, opClass operationClass, opResources map[string][]string, opMetadata interface{}, onRun func(*operation) error, onCancel func(*operation) error, onConnect func(*operation, *http.Request, http.ResponseWriter) error, r *http.Request) (*operation, error) {
+	return operationCreateWithID(uuid.NewRandom().String(), project, opClass, opResources, opMetadata, onRun, onCancel, onConnect, r)
+}
+
+// operationCreateWithID creates an operation like operationCreate but with a
+// given ID, so that resources named after it can be set up before the
+// operation is published.
+func operationCreateWithID(id string, project string, opClass operationClass, opResources map[string][]string, opMetadata interface{}, onRun func(*operation) error, onCancel func(*operation) error, onConnect func(*operation, *http.Request, http.ResponseWriter) error, r *http.Request) (*operation, error) {
 	// Main attributes
 	op := operation{}
 	op.project = project
-	op.id = uuid.NewRandom().String()
+	op.id = id
 	// op.description = opType.Description()
 	// op.permission = opType.Permission()
 	op.class = opClass
@@ -367,6 +426,10 @@ func operationCreate(project string, opClass operationClass, opResources map[str
 	op.resources = opResources
 	op.chanDone = make(chan error)
 
+	if r != nil {
+		op.requestor = newAuditRequestor(r)
+	}
+
 	newMetadata, err := shared.ParseMetadata(opMetadata)
 	if err != nil {
 		return nil, err
@@ -396,11 +459,16 @@ func operationCreate(project string, opClass operationClass, opResources map[str
 	}
 
 	operationsLock.Lock()
+	if operationsClosed {
+		operationsLock.Unlock()
+		return nil, errShuttingDown
+	}
+
 	operations[op.id] = &op
 	operationsLock.Unlock()
 
 	log.Printf("New %s Operation: %s\n", op.class.String(), op.id)
-	op.Render()
+	op.sendEvent()
 
 	return &op, nil
 }
@@ -1,81 +1,276 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/lxc/lxd/shared/api"
-	"github.com/mdlayher/vsock"
+	"github.com/lxc/lxd/shared/units"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 
 	"github.com/monstermunchkin/vsock/shared"
 )
 
 var flagPort uint64
+var flagListen listenFlag
+var flagCert string
+var flagKey string
+var flagTrustDir string
+var flagPolicy string
+var flagTokenFile string
+var flagTokenBoot bool
+var flagShutdownGrace time.Duration
+var flagCancelGrace time.Duration
+var flagLogDir string
+var flagLogRetention time.Duration
+var flagRecordingDir string
+var flagAuditLog string
+var flagAuditLogMaxSize string
+var flagAuditLogFiles int
 
 func init() {
-	flag.Uint64Var(&flagPort, "port", 8443, "Port to listen on")
+	flag.Uint64Var(&flagPort, "port", 8443, "vsock port to listen on when -listen isn't set")
+	flag.Var(&flagListen, "listen", "Address to listen on, repeatable (vsock://:PORT, unix:///PATH or tcp://HOST:PORT)")
+	flag.StringVar(&flagCert, "cert", "", "Server certificate, enables TLS")
+	flag.StringVar(&flagKey, "key", "", "Server key")
+	flag.StringVar(&flagTrustDir, "trust-dir", "", "Directory of trusted client certificates (required with -cert)")
+	flag.StringVar(&flagPolicy, "policy", "", "Policy file restricting the endpoints each peer CID may access")
+	flag.StringVar(&flagTokenFile, "token-file", "", "File of bearer tokens (one per line), enables token authentication")
+	flag.BoolVar(&flagTokenBoot, "token-boot", false, "Accept the bearer token passed as vsock.token= on the kernel command line or in SMBIOS OEM strings")
+	flag.DurationVar(&flagShutdownGrace, "shutdown-grace", 30*time.Second, "Time running operations get to finish on SIGTERM or SIGINT before they're cancelled")
+	flag.DurationVar(&flagCancelGrace, "cancel-grace", 10*time.Second, "Time cancelled commands get to exit after SIGTERM before they're killed")
+	flag.StringVar(&flagLogDir, "log-dir", "/var/log/vsock-server", "Directory for the output of detached commands")
+	flag.DurationVar(&flagLogRetention, "log-retention", 24*time.Hour, "How long detached commands and their output are kept once they're done")
+	flag.StringVar(&flagRecordingDir, "recording-dir", "", "Directory to record interactive commands to in asciicast v2 format (disabled if empty)")
+	flag.StringVar(&flagAuditLog, "audit-log", "", "Audit log destination: syslog, journald or the absolute path of a file (disabled if empty)")
+	flag.StringVar(&flagAuditLogMaxSize, "audit-log-max-size", "10MiB", "Size at which the audit log file is rotated")
+	flag.IntVar(&flagAuditLogFiles, "audit-log-files", 5, "Number of rotated audit log files to keep")
 }
 
 func main() {
+	// Internal helper starting commands with limits, see forkexec
+	if len(os.Args) > 1 && os.Args[1] == "forkexec" {
+		forkexec(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
+	log.SetOutput(io.MultiWriter(os.Stderr, eventLogWriter{}))
+
 	r := mux.NewRouter()
 	r.HandleFunc("/state", stateHandler)
-	r.HandleFunc("/1.0/exec", func(w http.ResponseWriter, r *http.Request) {
-		err := execHandler(w, r).Render(w)
-		if err != nil {
-			log.Println(errors.Wrap(err, "Failed to handle exec request"))
-		}
-	})
-	r.HandleFunc("/1.0/operations/{id}", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		id := mux.Vars(r)["id"]
-		var body *api.Operation
-
-		// First check if the query is for a local operation from this node
-		op, err := operationGetInternal(id)
-		if err == nil {
-			_, body, err = op.Render()
+	r.HandleFunc("/1.0", restHandler("server", api10Get)).Methods("GET")
+	r.HandleFunc("/1.0/events", restHandler("events", eventsGet)).Methods("GET")
+	r.HandleFunc("/1.0/exec", restHandler("exec", execHandler))
+	r.HandleFunc("/1.0/files", restHandler("file", fileGet)).Methods("GET")
+	r.HandleFunc("/1.0/files", restHandler("file", filePost)).Methods("POST")
+	r.HandleFunc("/1.0/files", restHandler("file", fileDelete)).Methods("DELETE")
+	r.HandleFunc("/1.0/files/archive", restHandler("file archive", fileArchiveGet)).Methods("GET")
+	r.HandleFunc("/1.0/files/archive", restHandler("file archive", fileArchivePost)).Methods("POST")
+	r.HandleFunc("/1.0/metrics", restHandler("metrics", metricsGet)).Methods("GET")
+	r.HandleFunc("/1.0/processes", restHandler("processes", processesGet)).Methods("GET")
+	r.HandleFunc("/1.0/operations", restHandler("operations", operationsGet)).Methods("GET")
+	r.HandleFunc("/1.0/operations/{id}", restHandler("operation", operationGet)).Methods("GET")
+	r.HandleFunc("/1.0/operations/{id}", restHandler("operation", operationDelete)).Methods("DELETE")
+	r.HandleFunc("/1.0/operations/{id}/logs", restHandler("operation logs", operationLogsGet)).Methods("GET")
+	r.HandleFunc("/1.0/operations/{id}/recording", restHandler("operation recording", operationRecordingGet)).Methods("GET")
+	r.HandleFunc("/1.0/operations/{id}/wait", restHandler("operation wait", operationWaitGet)).Methods("GET")
+	r.HandleFunc("/1.0/operations/{id}/websocket", restHandler("operation websocket", operationWebsocketGet)).Methods("GET")
+
+	var handler http.Handler = metricsHandler(r)
+	if flagTokenFile != "" || flagTokenBoot {
+		tokens := []string{}
+
+		if flagTokenFile != "" {
+			fileTokens, err := loadTokenFile(flagTokenFile)
 			if err != nil {
-				log.Println(errors.Wrap(err, "Failed to handle operations request"))
+				log.Fatal(err)
 			}
 
-			resp := SyncResponse(true, body)
-			resp.Render(w)
+			tokens = append(tokens, fileTokens...)
 		}
 
-		log.Println(errors.Wrap(err, "Failed to handle operations request"))
-	})
-	r.HandleFunc("/1.0/operations/{id}/websocket", func(w http.ResponseWriter, r *http.Request) {
-		id := mux.Vars(r)["id"]
+		if flagTokenBoot {
+			tokens = append(tokens, bootTokens()...)
+		}
 
-		// First check if the query is for a local operation from this node
-		op, err := operationGetInternal(id)
-		if err == nil {
-			resp := &OperationWebSocket{r, op}
-			err = resp.Render(w)
-			if err != nil {
-				log.Println(errors.Wrap(err, "Failed to handle operations request for websocket"))
-			}
+		var err error
+
+		handler, err = tokenHandler(tokens, handler)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if flagPolicy != "" {
+		var err error
+
+		handler, err = policyHandler(flagPolicy, handler)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Audit requests before they're checked so that denied ones are logged
+	if flagAuditLog != "" {
+		maxSize, err := units.ParseByteSizeString(flagAuditLogMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		auditLog, err = newAuditSink(flagAuditLog, maxSize, flagAuditLogFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer auditLog.Close()
+
+		handler = auditHandler(handler)
+	}
+
+	var config *tls.Config
+	if flagCert != "" {
+		if flagKey == "" || flagTrustDir == "" {
+			log.Fatal("-cert requires -key and -trust-dir")
 		}
-	})
 
-	http.Handle("/", r)
+		var err error
+
+		config, err = serverTLSConfig(flagCert, flagKey, flagTrustDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	l, err := vsock.Listen(uint32(flagPort))
+	listeners, err := activationListeners()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer l.Close()
 
-	log.Fatal(http.Serve(l, nil))
+	// Only listen on the default port if systemd didn't pass any sockets
+	if len(flagListen) == 0 && len(listeners) == 0 {
+		flagListen = listenFlag{fmt.Sprintf("vsock://:%d", flagPort)}
+	}
+
+	for _, uri := range flagListen {
+		l, err := listen(uri)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	for i, l := range listeners {
+		defer l.Close()
+
+		listenAddresses = append(listenAddresses, listenerURI(l))
+
+		if config != nil {
+			listeners[i] = tls.NewListener(l, config)
+		}
+	}
+
+	listenVsockCID = vsockContextID(listenAddresses)
+
+	// The watchdog is only pinged as long as the server answers requests
+	var watchdog *watchdogListener
+
+	interval := sdWatchdogInterval()
+	if interval > 0 {
+		watchdog = newWatchdogListener()
+		handler = watchdogHandler(handler)
+	}
+
+	srv := &http.Server{
+		Handler:     handler,
+		ConnContext: connContext,
+	}
+
+	chErr := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		log.Printf("Listening on %s\n", l.Addr())
+
+		go func(l net.Listener) {
+			chErr <- srv.Serve(l)
+		}(l)
+	}
+
+	if watchdog != nil {
+		go func() {
+			chErr <- srv.Serve(watchdog)
+		}()
+	}
+
+	status := fmt.Sprintf("STATUS=Serving on %s", strings.Join(listenAddresses, ", "))
+
+	err = sdNotify("READY=1\n" + status)
+	if err != nil {
+		log.Printf("Failed to notify the service manager: %v\n", err)
+	}
+
+	if watchdog != nil {
+		go sdWatchdog(watchdog, interval)
+	}
+
+	chSignal := make(chan os.Signal, 1)
+	signal.Notify(chSignal, unix.SIGTERM, unix.SIGINT)
+
+	chShutdown := make(chan bool)
+	go func() {
+		sig := <-chSignal
+		log.Printf("Received %s, shutting down\n", sig)
+
+		err := sdNotify("STOPPING=1")
+		if err != nil {
+			log.Printf("Failed to notify the service manager: %v\n", err)
+		}
+
+		shutdown(srv, flagShutdownGrace)
+		close(chShutdown)
+	}()
+
+	err = <-chErr
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-chShutdown
 }
 
+// restHandler renders the Response returned by f and logs rendering failures.
+func restHandler(name string, f func(http.ResponseWriter, *http.Request) Response) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := f(w, r).Render(w)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Failed to handle %s request", name))
+		}
+	}
+}
+
+// stateHandler renders the guest state. Pseudo filesystems are included in
+// the disk usage when the pseudo query parameter is set to 1.
 func stateHandler(w http.ResponseWriter, r *http.Request) {
+	options := shared.StateOptions{
+		PseudoFilesystems: queryParam(r, "pseudo") == "1",
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(shared.RenderState())
+	json.NewEncoder(w).Encode(shared.RenderStateWithOptions(options))
+}
+
+// processesGet returns the process table of the guest.
+func processesGet(w http.ResponseWriter, r *http.Request) Response {
+	return SyncResponse(true, shared.RenderProcesses())
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/monstermunchkin/vsock/shared"
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
+)
+
+// metricsExecDurationBuckets are the upper bounds of the exec duration
+// histogram in seconds.
+var metricsExecDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+var metricsLock sync.Mutex
+
+// metricsOperationsDone counts finished operations by class and status.
+var metricsOperationsDone = map[[2]string]uint64{}
+
+// metricsExecDuration is the histogram of exec durations.
+var metricsExecDuration = struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}{counts: make([]uint64, len(metricsExecDurationBuckets))}
+
+// Counters updated atomically
+var metricsWebsockets int64
+var metricsExecBytes = map[string]*uint64{
+	"stdin":  new(uint64),
+	"stdout": new(uint64),
+	"stderr": new(uint64),
+}
+
+// metricsOperationDone counts op as finished.
+func metricsOperationDone(op *operation) {
+	metricsLock.Lock()
+	metricsOperationsDone[[2]string{op.class.String(), op.status.String()}]++
+	metricsLock.Unlock()
+}
+
+// metricsExecObserve records the duration of a command.
+func metricsExecObserve(duration time.Duration) {
+	seconds := duration.Seconds()
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	for i, bound := range metricsExecDurationBuckets {
+		if seconds <= bound {
+			metricsExecDuration.counts[i]++
+		}
+	}
+
+	metricsExecDuration.count++
+	metricsExecDuration.sum += seconds
+}
+
+// metricsReader counts the bytes read from a stream of a command.
+type metricsReader struct {
+	io.ReadCloser
+	counter *uint64
+}
+
+func (r *metricsReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddUint64(r.counter, uint64(n))
+
+	return n, err
+}
+
+// metricsWriter counts the bytes written to a stream of a command.
+type metricsWriter struct {
+	io.WriteCloser
+	counter *uint64
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddUint64(w.counter, uint64(n))
+
+	return n, err
+}
+
+// metricsConn is a connection hijacked for a websocket.
+type metricsConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *metricsConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&metricsWebsockets, -1)
+	})
+
+	return c.Conn.Close()
+}
+
+// metricsResponseWriter tracks the connections hijacked for websockets.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *metricsResponseWriter) Flush() {
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (w *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	atomic.AddInt64(&metricsWebsockets, 1)
+
+	return &metricsConn{Conn: conn}, rw, nil
+}
+
+// metricsHandler counts the active websockets of next.
+func metricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&metricsResponseWriter{ResponseWriter: w}, r)
+	})
+}
+
+// metricsLabelEscaper escapes label values for the Prometheus text format.
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsSet writes metric families in the Prometheus text format.
+type metricsSet struct {
+	w io.Writer
+}
+
+// family starts the metric family name.
+func (m *metricsSet) family(name string, metricType string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes a sample of name with the given label names and values.
+func (m *metricsSet) sample(name string, value float64, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], metricsLabelEscaper.Replace(labels[i+1])))
+	}
+
+	if len(pairs) > 0 {
+		name = fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+	}
+
+	fmt.Fprintf(m.w, "%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// metricsGet returns the guest state and the agent metrics in the Prometheus
+// text format.
+func metricsGet(w http.ResponseWriter, r *http.Request) Response {
+	headers := map[string]string{
+		"Content-Type": "text/plain; version=0.0.4; charset=utf-8",
+	}
+
+	return StreamResponse(headers, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		m := &metricsSet{w: bw}
+
+		metricsGuest(m, shared.RenderState())
+		metricsAgent(m)
+
+		return bw.Flush()
+	})
+}
+
+// metricsGuest writes the guest state. Values which couldn't be collected
+// are left out.
+func metricsGuest(m *metricsSet, state *vsockapi.InstanceState) {
+	if state.CPU.Usage >= 0 {
+		m.family("vsock_cpu_seconds_total", "counter", "CPU time used in seconds.")
+		m.sample("vsock_cpu_seconds_total", float64(state.CPU.Usage)/float64(time.Second))
+	}
+
+	memory := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"vsock_memory_usage_bytes", "Memory usage in bytes.", state.Memory.Usage},
+		{"vsock_memory_usage_peak_bytes", "Peak memory usage in bytes.", state.Memory.UsagePeak},
+		{"vsock_memory_swap_usage_bytes", "Swap usage in bytes.", state.Memory.SwapUsage},
+		{"vsock_memory_swap_usage_peak_bytes", "Peak swap usage in bytes.", state.Memory.SwapUsagePeak},
+	}
+
+	for _, metric := range memory {
+		if metric.value < 0 {
+			continue
+		}
+
+		m.family(metric.name, "gauge", metric.help)
+		m.sample(metric.name, float64(metric.value))
+	}
+
+	// Sort devices and mount points for a stable output
+	disks := make([]string, 0, len(state.Disk))
+	for name := range state.Disk {
+		disks = append(disks, name)
+	}
+	sort.Strings(disks)
+
+	filesystem := []struct {
+		name  string
+		help  string
+		value func(disk vsockapi.InstanceStateDisk) int64
+	}{
+		{"vsock_filesystem_size_bytes", "Filesystem size in bytes.", func(disk vsockapi.InstanceStateDisk) int64 { return disk.Total }},
+		{"vsock_filesystem_usage_bytes", "Filesystem usage in bytes.", func(disk vsockapi.InstanceStateDisk) int64 { return disk.Usage }},
+		{"vsock_filesystem_free_bytes", "Filesystem space available to unprivileged users in bytes.", func(disk vsockapi.InstanceStateDisk) int64 { return disk.Free }},
+		{"vsock_filesystem_files", "Filesystem inodes.", func(disk vsockapi.InstanceStateDisk) int64 { return disk.InodesTotal }},
+		{"vsock_filesystem_files_free", "Free filesystem inodes.", func(disk vsockapi.InstanceStateDisk) int64 { return disk.InodesFree }},
+	}
+
+	if len(disks) > 0 {
+		for _, metric := range filesystem {
+			m.family(metric.name, "gauge", metric.help)
+			for _, name := range disks {
+				disk := state.Disk[name]
+				m.sample(metric.name, float64(metric.value(disk)), "device", name, "mountpoint", disk.Mountpoint)
+			}
+		}
+	}
+
+	interfaces := make([]string, 0, len(state.Network))
+	for name := range state.Network {
+		interfaces = append(interfaces, name)
+	}
+	sort.Strings(interfaces)
+
+	network := []struct {
+		name  string
+		help  string
+		value func(counters vsockapi.InstanceStateNetworkCounters) int64
+	}{
+		{"vsock_network_receive_bytes_total", "Bytes received.", func(c vsockapi.InstanceStateNetworkCounters) int64 { return c.BytesReceived }},
+		{"vsock_network_transmit_bytes_total", "Bytes sent.", func(c vsockapi.InstanceStateNetworkCounters) int64 { return c.BytesSent }},
+		{"vsock_network_receive_packets_total", "Packets received.", func(c vsockapi.InstanceStateNetworkCounters) int64 { return c.PacketsReceived }},
+		{"vsock_network_transmit_packets_total", "Packets sent.", func(c vsockapi.InstanceStateNetworkCounters) int64 { return c.PacketsSent }},
+	}
+
+	if len(interfaces) > 0 {
+		for _, metric := range network {
+			m.family(metric.name, "counter", metric.help)
+			for _, name := range interfaces {
+				m.sample(metric.name, float64(metric.value(state.Network[name].Counters)), "device", name)
+			}
+		}
+
+		m.family("vsock_network_up", "gauge", "Whether the interface is up.")
+		for _, name := range interfaces {
+			up := 0.0
+			if state.Network[name].State == "up" {
+				up = 1
+			}
+
+			m.sample("vsock_network_up", up, "device", name)
+		}
+	}
+
+	m.family("vsock_processes", "gauge", "Number of processes.")
+	m.sample("vsock_processes", float64(state.Processes))
+}
+
+// metricsAgent writes the metrics of the agent itself.
+func metricsAgent(m *metricsSet) {
+	// Operations currently known, including the ones kept after they're done
+	running := map[[2]string]int{}
+
+	operationsLock.Lock()
+	for _, op := range operations {
+		op.lock.Lock()
+		running[[2]string{op.class.String(), op.status.String()}]++
+		op.lock.Unlock()
+	}
+	operationsLock.Unlock()
+
+	m.family("vsock_operations", "gauge", "Operations by class and status.")
+	for _, key := range metricsSortedKeys(running) {
+		m.sample("vsock_operations", float64(running[key]), "class", key[0], "status", key[1])
+	}
+
+	metricsLock.Lock()
+	done := map[[2]string]int{}
+	for key, count := range metricsOperationsDone {
+		done[key] = int(count)
+	}
+
+	histogram := metricsExecDuration
+	histogram.counts = append([]uint64{}, metricsExecDuration.counts...)
+	metricsLock.Unlock()
+
+	m.family("vsock_operations_done_total", "counter", "Finished operations by class and final status.")
+	for _, key := range metricsSortedKeys(done) {
+		m.sample("vsock_operations_done_total", float64(done[key]), "class", key[0], "status", key[1])
+	}
+
+	m.family("vsock_websockets", "gauge", "Active websocket connections.")
+	m.sample("vsock_websockets", float64(atomic.LoadInt64(&metricsWebsockets)))
+
+	m.family("vsock_exec_duration_seconds", "histogram", "Run time of commands in seconds.")
+	for i, bound := range metricsExecDurationBuckets {
+		m.sample("vsock_exec_duration_seconds_bucket", float64(histogram.counts[i]), "le", strconv.FormatFloat(bound, 'f', -1, 64))
+	}
+	m.sample("vsock_exec_duration_seconds_bucket", float64(histogram.count), "le", "+Inf")
+	m.sample("vsock_exec_duration_seconds_sum", histogram.sum)
+	m.sample("vsock_exec_duration_seconds_count", float64(histogram.count))
+
+	m.family("vsock_exec_stream_bytes_total", "counter", "Bytes streamed between clients and commands.")
+	for _, stream := range []string{"stdin", "stdout", "stderr"} {
+		m.sample("vsock_exec_stream_bytes_total", float64(atomic.LoadUint64(metricsExecBytes[stream])), "stream", stream)
+	}
+}
+
+// metricsSortedKeys returns the class and status pairs of counts in order.
+func metricsSortedKeys(counts map[[2]string]int) [][2]string {
+	keys := make([][2]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+
+		return keys[i][1] < keys[j][1]
+	})
+
+	return keys
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	vsockapi "github.com/monstermunchkin/vsock/shared/api"
+)
+
+func TestMetricsSetSample(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   string
+		value    float64
+		labels   []string
+		expected string
+	}{
+		{"no labels", "vsock_processes", 42, nil, "vsock_processes 42\n"},
+		{"fraction", "vsock_cpu_seconds_total", 1.5, nil, "vsock_cpu_seconds_total 1.5\n"},
+		{"large value", "vsock_memory_usage_bytes", 17179869184, nil, "vsock_memory_usage_bytes 17179869184\n"},
+		{"small value", "vsock_exec_duration_seconds_sum", 0.000001, nil, "vsock_exec_duration_seconds_sum 0.000001\n"},
+		{"labels", "vsock_network_up", 1, []string{"device", "eth0", "state", "up"}, "vsock_network_up{device=\"eth0\",state=\"up\"} 1\n"},
+		{"escaped label", "vsock_filesystem_files", 0, []string{"mountpoint", "/mnt/a \"b\"\\c\nd"}, `vsock_filesystem_files{mountpoint="/mnt/a \"b\"\\c\nd"} 0` + "\n"},
+		{"odd label count", "vsock_websockets", 3, []string{"device", "eth0", "state"}, "vsock_websockets{device=\"eth0\"} 3\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			m := &metricsSet{w: buf}
+
+			m.sample(test.metric, test.value, test.labels...)
+			if buf.String() != test.expected {
+				t.Fatalf("Expected %q, got %q", test.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestMetricsGuest(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    vsockapi.InstanceState
+		expected []string
+	}{
+		{
+			name: "unavailable values",
+			state: vsockapi.InstanceState{
+				CPU:       vsockapi.InstanceStateCPU{Usage: -1},
+				Memory:    vsockapi.InstanceStateMemory{Usage: 1024, UsagePeak: -1, SwapUsage: -1, SwapUsagePeak: -1},
+				Processes: 7,
+			},
+			expected: []string{
+				"vsock_memory_usage_bytes 1024",
+				"vsock_processes 7",
+			},
+		},
+		{
+			name: "sorted devices",
+			state: vsockapi.InstanceState{
+				CPU:    vsockapi.InstanceStateCPU{Usage: int64(2500 * time.Millisecond)},
+				Memory: vsockapi.InstanceStateMemory{Usage: -1, UsagePeak: -1, SwapUsage: -1, SwapUsagePeak: -1},
+				Disk: map[string]vsockapi.InstanceStateDisk{
+					"vdb":  {Total: 2000, Usage: 500, Free: 1400, InodesTotal: 20, InodesFree: 15, Mountpoint: "/data"},
+					"vda1": {Total: 1000, Usage: 600, Free: 350, InodesTotal: 10, InodesFree: 4, Mountpoint: "/"},
+				},
+				Network: map[string]vsockapi.InstanceStateNetwork{
+					"lo":   {State: "up", Counters: vsockapi.InstanceStateNetworkCounters{BytesReceived: 1, BytesSent: 2, PacketsReceived: 3, PacketsSent: 4}},
+					"eth0": {State: "down", Counters: vsockapi.InstanceStateNetworkCounters{BytesReceived: 5, BytesSent: 6, PacketsReceived: 7, PacketsSent: 8}},
+				},
+			},
+			expected: []string{
+				"vsock_cpu_seconds_total 2.5",
+				`vsock_filesystem_size_bytes{device="vda1",mountpoint="/"} 1000`,
+				`vsock_filesystem_size_bytes{device="vdb",mountpoint="/data"} 2000`,
+				`vsock_filesystem_usage_bytes{device="vda1",mountpoint="/"} 600`,
+				`vsock_filesystem_usage_bytes{device="vdb",mountpoint="/data"} 500`,
+				`vsock_filesystem_free_bytes{device="vda1",mountpoint="/"} 350`,
+				`vsock_filesystem_free_bytes{device="vdb",mountpoint="/data"} 1400`,
+				`vsock_filesystem_files{device="vda1",mountpoint="/"} 10`,
+				`vsock_filesystem_files{device="vdb",mountpoint="/data"} 20`,
+				`vsock_filesystem_files_free{device="vda1",mountpoint="/"} 4`,
+				`vsock_filesystem_files_free{device="vdb",mountpoint="/data"} 15`,
+				`vsock_network_receive_bytes_total{device="eth0"} 5`,
+				`vsock_network_receive_bytes_total{device="lo"} 1`,
+				`vsock_network_transmit_bytes_total{device="eth0"} 6`,
+				`vsock_network_transmit_bytes_total{device="lo"} 2`,
+				`vsock_network_receive_packets_total{device="eth0"} 7`,
+				`vsock_network_receive_packets_total{device="lo"} 3`,
+				`vsock_network_transmit_packets_total{device="eth0"} 8`,
+				`vsock_network_transmit_packets_total{device="lo"} 4`,
+				`vsock_network_up{device="eth0"} 0`,
+				`vsock_network_up{device="lo"} 1`,
+				"vsock_processes 0",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			m := &metricsSet{w: buf}
+
+			metricsGuest(m, &test.state)
+
+			samples := metricsSamples(buf.String(), "")
+			if strings.Join(samples, "\n") != strings.Join(test.expected, "\n") {
+				t.Fatalf("Expected samples:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(samples, "\n"))
+			}
+		})
+	}
+}
+
+func TestMetricsExecDuration(t *testing.T) {
+	metricsLock.Lock()
+	metricsExecDuration.counts = make([]uint64, len(metricsExecDurationBuckets))
+	metricsExecDuration.count = 0
+	metricsExecDuration.sum = 0
+	metricsLock.Unlock()
+
+	for _, duration := range []time.Duration{50 * time.Millisecond, time.Second, 2 * time.Second, 2 * time.Hour} {
+		metricsExecObserve(duration)
+	}
+
+	buf := &bytes.Buffer{}
+	m := &metricsSet{w: buf}
+
+	metricsAgent(m)
+
+	expected := []string{
+		`vsock_exec_duration_seconds_bucket{le="0.1"} 1`,
+		`vsock_exec_duration_seconds_bucket{le="0.5"} 1`,
+		`vsock_exec_duration_seconds_bucket{le="1"} 2`,
+		`vsock_exec_duration_seconds_bucket{le="5"} 3`,
+		`vsock_exec_duration_seconds_bucket{le="10"} 3`,
+		`vsock_exec_duration_seconds_bucket{le="30"} 3`,
+		`vsock_exec_duration_seconds_bucket{le="60"} 3`,
+		`vsock_exec_duration_seconds_bucket{le="300"} 3`,
+		`vsock_exec_duration_seconds_bucket{le="900"} 3`,
+		`vsock_exec_duration_seconds_bucket{le="3600"} 3`,
+		`vsock_exec_duration_seconds_bucket{le="+Inf"} 4`,
+		"vsock_exec_duration_seconds_sum 7203.05",
+		"vsock_exec_duration_seconds_count 4",
+	}
+
+	samples := metricsSamples(buf.String(), "vsock_exec_duration_seconds")
+	if strings.Join(samples, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected samples:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(samples, "\n"))
+	}
+}
+
+// metricsSamples returns the sample lines of output starting with prefix.
+func metricsSamples(output string, prefix string) []string {
+	samples := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") || !strings.HasPrefix(line, prefix) {
+			continue
+		}
+
+		samples = append(samples, line)
+	}
+
+	return samples
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/version"
+)
+
+// operationsGet returns all operations grouped by their status. Without
+// recursion only the operation URLs are returned.
+func operationsGet(w http.ResponseWriter, r *http.Request) Response {
+	recursion, _ := strconv.Atoi(queryParam(r, "recursion"))
+
+	operationsLock.Lock()
+	ops := make([]*operation, 0, len(operations))
+	for _, op := range operations {
+		ops = append(ops, op)
+	}
+	operationsLock.Unlock()
+
+	if recursion == 0 {
+		urls := map[string][]string{}
+
+		for _, op := range ops {
+			op.lock.Lock()
+			status := strings.ToLower(op.status.String())
+			op.lock.Unlock()
+
+			urls[status] = append(urls[status], fmt.Sprintf("/%s/operations/%s", version.APIVersion, op.id))
+		}
+
+		return SyncResponse(true, urls)
+	}
+
+	body := map[string][]*api.Operation{}
+
+	for _, op := range ops {
+		_, md, err := op.Render()
+		if err != nil {
+			return InternalError(err)
+		}
+
+		status := strings.ToLower(md.Status)
+		body[status] = append(body[status], md)
+	}
+
+	return SyncResponse(true, body)
+}
+
+// operationGet returns a single operation.
+func operationGet(w http.ResponseWriter, r *http.Request) Response {
+	id := mux.Vars(r)["id"]
+
+	op, err := operationGetInternal(id)
+	if err != nil {
+		return NotFound(err)
+	}
+
+	_, body, err := op.Render()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	return SyncResponse(true, body)
+}
+
+// operationDelete cancels a running operation.
+func operationDelete(w http.ResponseWriter, r *http.Request) Response {
+	id := mux.Vars(r)["id"]
+
+	op, err := operationGetInternal(id)
+	if err != nil {
+		return NotFound(err)
+	}
+
+	_, err = op.Cancel()
+	if err != nil {
+		return BadRequest(err)
+	}
+
+	return EmptySyncResponse
+}
+
+// operationLogsGet returns the output of a detached exec operation. With
+// follow=1, the output is streamed until the operation is done.
+func operationLogsGet(w http.ResponseWriter, r *http.Request) Response {
+	id := mux.Vars(r)["id"]
+
+	op, err := operationGetInternal(id)
+	if err != nil {
+		return NotFound(err)
+	}
+
+	f, err := os.Open(execLogPath(op.id))
+	if os.IsNotExist(err) {
+		return NotFound(fmt.Errorf("Operation '%s' has no logs", id))
+	}
+
+	if err != nil {
+		return SmartError(err)
+	}
+
+	follow := queryParam(r, "follow") == "1"
+	headers := map[string]string{"Content-Type": "text/plain"}
+
+	return StreamResponse(headers, func(w io.Writer) error {
+		defer f.Close()
+
+		for {
+			// Check before copying so that no output written at the end is missed
+			done := !follow
+			select {
+			case <-op.chanDone:
+				done = true
+			default:
+			}
+
+			_, err := io.Copy(w, f)
+			if err != nil {
+				return err
+			}
+
+			if done {
+				return nil
+			}
+
+			flusher, ok := w.(http.Flusher)
+			if ok {
+				flusher.Flush()
+			}
+
+			select {
+			case <-op.chanDone:
+			case <-r.Context().Done():
+				return nil
+			case <-time.After(250 * time.Millisecond):
+			}
+		}
+	})
+}
+
+// operationWaitGet blocks until the operation reaches a final state or the
+// timeout (in seconds) expires. A timeout of -1, the default, waits forever.
+func operationWaitGet(w http.ResponseWriter, r *http.Request) Response {
+	id := mux.Vars(r)["id"]
+
+	timeout := -1
+	if r.FormValue("timeout") != "" {
+		var err error
+
+		timeout, err = strconv.Atoi(r.FormValue("timeout"))
+		if err != nil {
+			return BadRequest(err)
+		}
+	}
+
+	op, err := operationGetInternal(id)
+	if err != nil {
+		return NotFound(err)
+	}
+
+	_, err = op.WaitFinal(timeout)
+	if err != nil {
+		return InternalError(err)
+	}
+
+	_, body, err := op.Render()
+	if err != nil {
+		return InternalError(err)
+	}
+
+	return SyncResponse(true, body)
+}
+
+// operationWebsocketGet connects to the websocket of an operation.
+func operationWebsocketGet(w http.ResponseWriter, r *http.Request) Response {
+	id := mux.Vars(r)["id"]
+
+	op, err := operationGetInternal(id)
+	if err != nil {
+		return NotFound(err)
+	}
+
+	return &OperationWebSocket{r, op}
+}
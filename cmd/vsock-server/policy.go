@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mdlayher/vsock"
+	"golang.org/x/sys/unix"
+)
+
+type contextKey int
+
+// contextPeer is the context key under which the peer address of a
+// connection is stored.
+const contextPeer contextKey = iota
+
+// connContext records the peer address of new connections in their context.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, contextPeer, c.RemoteAddr())
+}
+
+// peerName returns the context ID of a vsock peer, or "unix" and "tcp" for
+// peers connected over Unix sockets and TCP.
+func peerName(r *http.Request) (string, bool) {
+	switch addr := r.Context().Value(contextPeer).(type) {
+	case *vsock.Addr:
+		return strconv.FormatUint(uint64(addr.ContextID), 10), true
+	case *net.UnixAddr:
+		return "unix", true
+	case *net.TCPAddr:
+		return "tcp", true
+	}
+
+	return "", false
+}
+
+// cidPolicy maps peer context IDs, "unix" and "tcp" for peers connected over
+// Unix sockets and TCP, or "*" for any other peer, to the endpoint paths they
+// may access. A path also allows everything below it and "*"
+// allows all endpoints.
+type cidPolicy map[string][]string
+
+// allowed returns whether peer may access path.
+func (p cidPolicy) allowed(peer string, path string) bool {
+	endpoints, ok := p[peer]
+	if !ok {
+		endpoints, ok = p["*"]
+		if !ok {
+			return false
+		}
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint == "*" || path == endpoint || strings.HasPrefix(path, strings.TrimSuffix(endpoint, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadCIDPolicy reads a JSON policy file such as:
+//
+//	{
+//	  "2": ["*"],
+//	  "*": ["/state"]
+//	}
+func loadCIDPolicy(path string) (cidPolicy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := cidPolicy{}
+
+	err = json.Unmarshal(content, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse policy %q: %v", path, err)
+	}
+
+	for cid := range policy {
+		if cid == "*" || cid == "unix" || cid == "tcp" {
+			continue
+		}
+
+		_, err := strconv.ParseUint(cid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid context ID %q in policy %q", cid, path)
+		}
+	}
+
+	return policy, nil
+}
+
+// policyHandler only passes requests to next if the peer is allowed to
+// access the endpoint by the policy in path, which is reloaded on SIGHUP.
+func policyHandler(path string, next http.Handler) (http.Handler, error) {
+	policy, err := loadCIDPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.RWMutex
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, unix.SIGHUP)
+
+	go func() {
+		for range ch {
+			newPolicy, err := loadCIDPolicy(path)
+			if err != nil {
+				log.Printf("Failed to reload policy, keeping the current one: %v\n", err)
+				continue
+			}
+
+			lock.Lock()
+			policy = newPolicy
+			lock.Unlock()
+
+			log.Printf("Reloaded policy %q\n", path)
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := peerName(r)
+		if !ok {
+			Forbidden(fmt.Errorf("Unknown peer")).Render(w)
+			return
+		}
+
+		lock.RLock()
+		allowed := policy.allowed(peer, r.URL.Path)
+		lock.RUnlock()
+
+		if !allowed {
+			log.Printf("Denied access to %q for peer %s\n", r.URL.Path, peer)
+			Forbidden(nil).Render(w)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCIDPolicyAllowed(t *testing.T) {
+	policy := cidPolicy{
+		"2":    {"*"},
+		"3":    {"/1.0/files", "/1.0/operations/"},
+		"4":    {},
+		"unix": {"/1.0"},
+		"*":    {"/state"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  cidPolicy
+		peer    string
+		path    string
+		allowed bool
+	}{
+		{"wildcard endpoint", policy, "2", "/1.0/exec", true},
+		{"exact endpoint", policy, "3", "/1.0/files", true},
+		{"endpoint below", policy, "3", "/1.0/files/archive", true},
+		{"endpoint with trailing slash", policy, "3", "/1.0/operations/abc/wait", true},
+		{"endpoint prefix only", policy, "3", "/1.0/filesystem", false},
+		{"other endpoint", policy, "3", "/1.0/exec", false},
+		{"no endpoints", policy, "4", "/state", false},
+		{"unix socket", policy, "unix", "/1.0/exec", true},
+		{"unix socket other endpoint", policy, "unix", "/state", false},
+		{"fallback", policy, "5", "/state", true},
+		{"fallback other endpoint", policy, "tcp", "/1.0/exec", false},
+		{"no fallback", cidPolicy{"2": {"*"}}, "5", "/state", false},
+		{"empty policy", cidPolicy{}, "2", "/state", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed := test.policy.allowed(test.peer, test.path)
+			if allowed != test.allowed {
+				t.Fatalf("Expected %v for peer %q and path %q, got %v", test.allowed, test.peer, test.path, allowed)
+			}
+		})
+	}
+}
+
+func TestLoadCIDPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     bool
+	}{
+		{"valid", `{"2": ["*"], "unix": ["/1.0"], "tcp": [], "*": ["/state"]}`, false},
+		{"empty", `{}`, false},
+		{"invalid JSON", `{"2": "*"}`, true},
+		{"invalid context ID", `{"host": ["*"]}`, true},
+		{"negative context ID", `{"-1": ["*"]}`, true},
+		{"context ID out of range", `{"4294967296": ["*"]}`, true},
+	}
+
+	dir, err := ioutil.TempDir("", "vsock-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("policy%d.json", i))
+
+			err := ioutil.WriteFile(path, []byte(test.content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadCIDPolicy(path)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastRecorder records a terminal session in asciicast v2 format.
+type asciicastRecorder struct {
+	f     *os.File
+	start time.Time
+
+	// pending holds an incomplete UTF-8 sequence at the end of the output
+	pending []byte
+	lock    sync.Mutex
+}
+
+// recordingPath returns the path of the recording of exec operation id.
+func recordingPath(id string) string {
+	return filepath.Join(flagRecordingDir, fmt.Sprintf("%s.cast", id))
+}
+
+// newAsciicastRecorder starts the recording of operation id running command
+// in a terminal of the given size.
+func newAsciicastRecorder(id string, width int, height int, command []string, env map[string]string) (*asciicastRecorder, error) {
+	err := os.MkdirAll(flagRecordingDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(recordingPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Players need a terminal size
+	if width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	r := &asciicastRecorder{
+		f:     f,
+		start: time.Now(),
+	}
+
+	header := asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Command:   strings.Join(command, " "),
+		Env:       map[string]string{},
+	}
+
+	term, ok := env["TERM"]
+	if ok {
+		header.Env["TERM"] = term
+	}
+
+	err = json.NewEncoder(f).Encode(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// event appends an event of type code to the recording.
+func (r *asciicastRecorder) event(code string, data string) error {
+	elapsed := time.Since(r.start).Seconds()
+
+	return json.NewEncoder(r.f).Encode([]interface{}{elapsed, code, data})
+}
+
+// Output records terminal output.
+func (r *asciicastRecorder) Output(p []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	data := append(r.pending, p...)
+
+	// Hold back a UTF-8 sequence split across reads
+	n := len(data)
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				n = len(data) - i
+			}
+
+			break
+		}
+	}
+
+	r.pending = append([]byte{}, data[n:]...)
+	if n == 0 {
+		return nil
+	}
+
+	return r.event("o", string(data[:n]))
+}
+
+// Resize records a change of the terminal size.
+func (r *asciicastRecorder) Resize(width int, height int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes pending output and ends the recording.
+func (r *asciicastRecorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+
+	return r.f.Close()
+}
+
+// recordingReader records everything read from a terminal.
+type recordingReader struct {
+	io.ReadCloser
+	recorder *asciicastRecorder
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.recorder.Output(p[:n])
+	}
+
+	return n, err
+}
+
+// operationRecordingGet returns the asciicast recording of an interactive
+// exec operation. Recordings outlive their operation.
+func operationRecordingGet(w http.ResponseWriter, r *http.Request) Response {
+	id := mux.Vars(r)["id"]
+
+	if flagRecordingDir == "" {
+		return NotFound(fmt.Errorf("Recording is disabled"))
+	}
+
+	// The ID is used as a file name
+	if uuid.Parse(id) == nil {
+		return BadRequest(fmt.Errorf("Invalid operation ID %q", id))
+	}
+
+	path := recordingPath(id)
+
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return NotFound(fmt.Errorf("Operation '%s' has no recording", id))
+	}
+
+	if err != nil {
+		return SmartError(err)
+	}
+
+	files := []fileResponseEntry{{
+		identifier: id,
+		path:       path,
+		filename:   filepath.Base(path),
+	}}
+
+	return FileResponse(r, files, nil, false)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAsciicastRecorderOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		events []string
+	}{
+		{"ASCII", []string{"hello ", "world\r\n"}, []string{"hello ", "world\r\n"}},
+		{"whole runes", []string{"grüße ", "✓\r\n"}, []string{"grüße ", "✓\r\n"}},
+		{"split two byte rune", []string{"gr\xc3", "\xbc\xc3\x9fe"}, []string{"gr", "üße"}},
+		{"split three byte rune", []string{"ok \xe2", "\x9c", "\x93"}, []string{"ok ", "✓"}},
+		{"split four byte rune", []string{"\xf0\x9f", "\x98\x80", " done"}, []string{"😀", " done"}},
+		{"rune alone in chunk", []string{"\xe2", "\x9c\x93", "\xe2\x9c\x93"}, []string{"✓", "✓"}},
+		{"invalid byte", []string{"bad \xff", "byte"}, []string{"bad \ufffd", "byte"}},
+		{"incomplete at close", []string{"end \xe2\x9c"}, []string{"end ", "\ufffd\ufffd"}},
+	}
+
+	dir, err := ioutil.TempDir("", "vsock-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(recordingDir string) {
+		flagRecordingDir = recordingDir
+	}(flagRecordingDir)
+	flagRecordingDir = dir
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := strings.Replace(test.name, " ", "-", -1)
+
+			recorder, err := newAsciicastRecorder(id, 80, 24, []string{"bash"}, map[string]string{"TERM": "xterm"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, chunk := range test.chunks {
+				err := recorder.Output([]byte(chunk))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = recorder.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := os.Open(filepath.Join(dir, id+".cast"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			scanner := bufio.NewScanner(f)
+			if !scanner.Scan() {
+				t.Fatalf("Missing header")
+			}
+
+			header := asciicastHeader{}
+			err = json.Unmarshal(scanner.Bytes(), &header)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Env["TERM"] != "xterm" {
+				t.Fatalf("Unexpected header: %+v", header)
+			}
+
+			// Incomplete runes are held back until the next output or the end
+			events := []string{}
+			for scanner.Scan() {
+				event := []interface{}{}
+				err = json.Unmarshal(scanner.Bytes(), &event)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(event) != 3 || event[1] != "o" {
+					t.Fatalf("Unexpected event: %v", event)
+				}
+
+				events = append(events, event[2].(string))
+			}
+
+			if !reflect.DeepEqual(events, test.events) {
+				t.Fatalf("Expected events %q, got %q", test.events, events)
+			}
+		})
+	}
+}
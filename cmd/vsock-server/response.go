@@ -268,6 +268,44 @@ func FileResponse(r *http.Request, files []fileResponseEntry, headers map[string
 	return &fileResponse{r, files, headers, removeAfterServe}
 }
 
+// Streaming response
+type streamResponse struct {
+	headers map[string]string
+	stream  func(w io.Writer) error
+}
+
+// streamErrorTrailer is the trailer carrying errors which occurred after the
+// response headers were sent.
+const streamErrorTrailer = "X-LXD-error"
+
+func (r *streamResponse) Render(w http.ResponseWriter) error {
+	for k, v := range r.headers {
+		w.Header().Set(k, v)
+	}
+
+	w.Header().Set("Trailer", streamErrorTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	err := r.stream(w)
+	if err != nil {
+		w.Header().Set(streamErrorTrailer, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (r *streamResponse) String() string {
+	return "stream"
+}
+
+// StreamResponse writes the output of stream as the response body. As the
+// status code has already been sent by then, errors returned by stream are
+// reported in the X-LXD-error trailer.
+func StreamResponse(headers map[string]string, stream func(w io.Writer) error) Response {
+	return &streamResponse{headers, stream}
+}
+
 // Operation response
 type operationResponse struct {
 	op *operation
@@ -447,5 +485,16 @@ func PreconditionFailed(err error) Response {
  * SmartError returns the right error message based on err.
  */
 func SmartError(err error) Response {
-	return EmptySyncResponse
+	switch {
+	case err == nil:
+		return EmptySyncResponse
+	case os.IsNotExist(err):
+		return NotFound(err)
+	case os.IsPermission(err):
+		return Forbidden(err)
+	case os.IsExist(err):
+		return Conflict(err)
+	default:
+		return InternalError(err)
+	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shutdownClientTimeout is how long clients get to fetch the final state of
+// their operations once all operations are done.
+const shutdownClientTimeout = 5 * time.Second
+
+// shutdown stops srv from accepting new connections and operations, gives
+// running operations up to grace to finish and cancels the rest.
+func shutdown(srv *http.Server, grace time.Duration) {
+	operationsLock.Lock()
+	operationsClosed = true
+	operationsLock.Unlock()
+
+	// Stop listening right away, existing connections are served until they
+	// become idle
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chShutdown := make(chan error, 1)
+	go func() {
+		chShutdown <- srv.Shutdown(ctx)
+	}()
+
+	operationsDrain(grace)
+
+	select {
+	case err := <-chShutdown:
+		if err != nil {
+			log.Printf("Failed to shut down the server: %v\n", err)
+		}
+	case <-time.After(shutdownClientTimeout):
+		cancel()
+		<-chShutdown
+	}
+}
+
+// operationsDrain waits up to grace for all operations to finish and then
+// cancels the remaining ones.
+func operationsDrain(grace time.Duration) {
+	operationsLock.Lock()
+	ops := make([]*operation, 0, len(operations))
+	for _, op := range operations {
+		ops = append(ops, op)
+	}
+	operationsLock.Unlock()
+
+	log.Printf("Waiting up to %s for %d operations to finish\n", grace, len(ops))
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	for _, op := range ops {
+		select {
+		case <-op.chanDone:
+		case <-timer.C:
+			operationsCancel(ops)
+			return
+		}
+	}
+}
+
+// operationsCancel cancels the unfinished operations of ops and waits for
+// them to stop.
+func operationsCancel(ops []*operation) {
+	var wg sync.WaitGroup
+
+	for _, op := range ops {
+		op.lock.Lock()
+		final := op.status.IsFinal()
+		op.lock.Unlock()
+
+		if final {
+			continue
+		}
+
+		chanCancel, err := op.Cancel()
+		if err != nil {
+			log.Printf("Failed to cancel %s Operation: %s: %s\n", op.class.String(), op.id, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(op *operation) {
+			defer wg.Done()
+
+			err := <-chanCancel
+			if err != nil {
+				log.Printf("Failed to cancel %s Operation: %s: %s\n", op.class.String(), op.id, err)
+			}
+		}(op)
+	}
+
+	wg.Wait()
+}
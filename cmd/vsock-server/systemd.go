@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/vsock"
+	"golang.org/x/sys/unix"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFdsStart = 3
+
+// activationListeners returns the listeners passed by systemd socket
+// activation through LISTEN_PID and LISTEN_FDS, if any.
+func activationListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return nil, nil
+	}
+
+	listeners := []net.Listener{}
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		unix.CloseOnExec(fd)
+
+		l, err := fileListener(fd)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to use socket-activated file descriptor %d: %v", fd, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// fileListener creates a listener for the listening socket fd.
+func fileListener(fd int) (net.Listener, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	// The net package doesn't know about AF_VSOCK
+	vm, ok := sa.(*unix.SockaddrVM)
+	if !ok {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+		defer f.Close()
+
+		return net.FileListener(f)
+	}
+
+	err = unix.SetNonblock(fd, true)
+	if err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d", vm.Port))
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &vsockFileListener{
+		f:    f,
+		rc:   rc,
+		addr: &vsock.Addr{ContextID: vm.CID, Port: vm.Port},
+	}, nil
+}
+
+// vsockFileListener is a net.Listener on an inherited AF_VSOCK socket.
+type vsockFileListener struct {
+	f    *os.File
+	rc   syscall.RawConn
+	addr *vsock.Addr
+}
+
+func (l *vsockFileListener) Accept() (net.Conn, error) {
+	var nfd int
+	var sa unix.Sockaddr
+	var err error
+
+	doErr := l.rc.Read(func(fd uintptr) bool {
+		nfd, sa, err = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return err != unix.EAGAIN
+	})
+	if doErr != nil {
+		return nil, doErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	remote := &vsock.Addr{}
+	vm, ok := sa.(*unix.SockaddrVM)
+	if ok {
+		remote.ContextID = vm.CID
+		remote.Port = vm.Port
+	}
+
+	return &vsockFileConn{
+		File:   os.NewFile(uintptr(nfd), fmt.Sprintf("vsock:%d", l.addr.Port)),
+		local:  l.addr,
+		remote: remote,
+	}, nil
+}
+
+func (l *vsockFileListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockFileListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockFileConn is a net.Conn accepted by a vsockFileListener.
+type vsockFileConn struct {
+	*os.File
+	local  *vsock.Addr
+	remote *vsock.Addr
+}
+
+func (c *vsockFileConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockFileConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// sdNotify sends state to the service manager, if the agent was started with
+// NOTIFY_SOCKET set.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Abstract socket
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval at which the service manager
+// expects WATCHDOG=1, or 0 if the watchdog isn't enabled for the agent.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	// Ping twice per timeout as recommended by sd_watchdog_enabled(3)
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdogAddr is the address of the in-memory connections the watchdog uses
+// to check that the server still serves requests.
+type watchdogAddr struct{}
+
+func (watchdogAddr) Network() string {
+	return "watchdog"
+}
+
+func (watchdogAddr) String() string {
+	return "watchdog"
+}
+
+// watchdogConn is the server side of a connection dialed by the watchdog.
+type watchdogConn struct {
+	net.Conn
+}
+
+func (c *watchdogConn) LocalAddr() net.Addr {
+	return watchdogAddr{}
+}
+
+func (c *watchdogConn) RemoteAddr() net.Addr {
+	return watchdogAddr{}
+}
+
+// watchdogListener is an in-memory listener served next to the real ones so
+// that the watchdog goes through the same server as the clients.
+type watchdogListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWatchdogListener() *watchdogListener {
+	return &watchdogListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *watchdogListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("Watchdog listener closed")
+	}
+}
+
+func (l *watchdogListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *watchdogListener) Addr() net.Addr {
+	return watchdogAddr{}
+}
+
+// Dial connects to the listener, failing if the server doesn't accept the
+// connection before ctx is done.
+func (l *watchdogListener) Dial(ctx context.Context) (net.Conn, error) {
+	server, client := net.Pipe()
+
+	select {
+	case l.conns <- &watchdogConn{Conn: server}:
+		return client, nil
+	case <-l.done:
+		err := fmt.Errorf("Watchdog listener closed")
+		client.Close()
+		server.Close()
+		return nil, err
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// watchdogHandler answers the requests of the watchdog, once the server is
+// able to take the operations lock, and passes all others to next.
+func watchdogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Value(contextPeer).(watchdogAddr)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		operationsLock.Lock()
+		operationsLock.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// sdWatchdog sends WATCHDOG=1 every interval, but only if a request to l
+// was served in time.
+func sdWatchdog(l *watchdogListener, interval time.Duration) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return l.Dial(ctx)
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: interval,
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+
+		resp, err := client.Get("http://watchdog/")
+		if err != nil {
+			log.Printf("Watchdog request failed: %v\n", err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Watchdog request failed: %s\n", resp.Status)
+			continue
+		}
+
+		err = sdNotify("WATCHDOG=1")
+		if err != nil {
+			log.Printf("Failed to notify the service manager: %v\n", err)
+		}
+	}
+}
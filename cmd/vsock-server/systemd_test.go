@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSdWatchdog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsock-systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	l := newWatchdogListener()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	srv := &http.Server{
+		Handler:     watchdogHandler(next),
+		ConnContext: connContext,
+	}
+
+	chErr := make(chan error, 1)
+	go func() {
+		chErr <- srv.Serve(l)
+	}()
+
+	chDone := make(chan bool)
+	go func() {
+		sdWatchdog(l, 10*time.Millisecond)
+		close(chDone)
+	}()
+
+	buf := make([]byte, 64)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != "WATCHDOG=1" {
+		t.Fatalf("Expected WATCHDOG=1, got %q", buf[:n])
+	}
+
+	// The watchdog stops once the server is closed
+	srv.Close()
+	<-chErr
+
+	select {
+	case <-chDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watchdog still running after the server was closed")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+// trustedCertificates loads all PEM encoded certificates from the files in
+// dir.
+func trustedCertificates(dir string) ([]*x509.Certificate, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			var block *pem.Block
+
+			block, content = pem.Decode(content)
+			if block == nil {
+				break
+			}
+
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				log.Printf("Skipping invalid certificate in %q: %v\n", path, err)
+				continue
+			}
+
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+// serverTLSConfig returns a TLS configuration serving the given certificate
+// and only accepting clients presenting one of the certificates in trustDir.
+// The trust store is read on every handshake so that certificates can be
+// added or removed without restarting the agent.
+func serverTLSConfig(certFile string, keyFile string, trustDir string) (*tls.Config, error) {
+	keypair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load server certificate: %v", err)
+	}
+
+	// Fail early on an unreadable trust store
+	_, err = trustedCertificates(trustDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load trust store: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{keypair},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("No client certificate provided")
+			}
+
+			trusted, err := trustedCertificates(trustDir)
+			if err != nil {
+				return fmt.Errorf("Failed to load trust store: %v", err)
+			}
+
+			for _, cert := range trusted {
+				if bytes.Equal(cert.Raw, rawCerts[0]) {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("Client certificate isn't trusted")
+		},
+	}
+
+	return config, nil
+}
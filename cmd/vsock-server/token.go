@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// bootTokenKey is the key of the token passed on the kernel command line or
+// as an SMBIOS OEM string.
+const bootTokenKey = "vsock.token"
+
+// The kernel command line and the raw SMBIOS OEM strings structures boot
+// tokens are read from.
+var bootCmdlinePath = "/proc/cmdline"
+var bootSMBIOSEntries = "/sys/firmware/dmi/entries/11-*/raw"
+
+// loadTokenFile reads one token per line from path, skipping empty lines and
+// comments.
+func loadTokenFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens = append(tokens, line)
+	}
+
+	return tokens, nil
+}
+
+// bootTokens returns the tokens injected at boot through vsock.token= on the
+// kernel command line or in the SMBIOS OEM strings (type 11).
+func bootTokens() []string {
+	tokens := []string{}
+
+	cmdline, err := ioutil.ReadFile(bootCmdlinePath)
+	if err == nil {
+		for _, field := range strings.Fields(string(cmdline)) {
+			if strings.HasPrefix(field, bootTokenKey+"=") {
+				tokens = append(tokens, strings.TrimPrefix(field, bootTokenKey+"="))
+			}
+		}
+	}
+
+	entries, err := filepath.Glob(bootSMBIOSEntries)
+	if err != nil {
+		return tokens
+	}
+
+	for _, entry := range entries {
+		raw, err := ioutil.ReadFile(entry)
+		if err != nil {
+			continue
+		}
+
+		for _, value := range smbiosStrings(raw) {
+			if strings.HasPrefix(value, bootTokenKey+"=") {
+				tokens = append(tokens, strings.TrimPrefix(value, bootTokenKey+"="))
+			}
+		}
+	}
+
+	return tokens
+}
+
+// smbiosStrings returns the strings following the formatted area of a raw
+// SMBIOS structure.
+func smbiosStrings(raw []byte) []string {
+	if len(raw) < 2 || int(raw[1]) > len(raw) {
+		return nil
+	}
+
+	values := []string{}
+	for _, value := range bytes.Split(raw[raw[1]:], []byte{0}) {
+		if len(value) == 0 {
+			break
+		}
+
+		values = append(values, string(value))
+	}
+
+	return values
+}
+
+// tokenHandler only passes requests, including websocket upgrades, to next if
+// they carry one of tokens in an "Authorization: Bearer" header.
+func tokenHandler(tokens []string, next http.Handler) (http.Handler, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("No tokens configured")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			Forbidden(fmt.Errorf("Missing bearer token")).Render(w)
+			return
+		}
+
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+		// Compare against all tokens to not leak which one matched
+		valid := 0
+		for _, t := range tokens {
+			valid |= subtle.ConstantTimeCompare(token, []byte(t))
+		}
+
+		if valid != 1 {
+			log.Printf("Denied access to %q: invalid bearer token\n", r.URL.Path)
+			Forbidden(nil).Render(w)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSMBIOSStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      []byte
+		expected []string
+	}{
+		{
+			name:     "strings",
+			raw:      []byte("\x0b\x05\x00\x01\x02vsock.token=abc\x00other\x00\x00"),
+			expected: []string{"vsock.token=abc", "other"},
+		},
+		{
+			name:     "no strings",
+			raw:      []byte("\x0b\x05\x00\x01\x00\x00\x00"),
+			expected: []string{},
+		},
+		{
+			name:     "missing terminator",
+			raw:      []byte("\x0b\x05\x00\x01\x01vsock.token=abc"),
+			expected: []string{"vsock.token=abc"},
+		},
+		{
+			name: "too short",
+			raw:  []byte("\x0b"),
+		},
+		{
+			name: "formatted area beyond the end",
+			raw:  []byte("\x0b\x20\x00\x01"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := smbiosStrings(test.raw)
+			if !reflect.DeepEqual(values, test.expected) {
+				t.Fatalf("Expected %q, got %q", test.expected, values)
+			}
+		})
+	}
+}
+
+func TestBootTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdline  string
+		smbios   [][]byte
+		expected []string
+	}{
+		{
+			name:     "none",
+			cmdline:  "console=ttyS0 root=/dev/vda1 ro\n",
+			expected: []string{},
+		},
+		{
+			name:     "kernel command line",
+			cmdline:  "console=ttyS0 vsock.token=abc ro vsock.token=def\n",
+			expected: []string{"abc", "def"},
+		},
+		{
+			name:     "similar key",
+			cmdline:  "vsock.tokens=abc myvsock.token=def\n",
+			expected: []string{},
+		},
+		{
+			name:    "SMBIOS OEM strings",
+			cmdline: "ro\n",
+			smbios: [][]byte{
+				[]byte("\x0b\x05\x00\x01\x02io.systemd.credential:foo=bar\x00vsock.token=ghi\x00\x00"),
+			},
+			expected: []string{"ghi"},
+		},
+		{
+			name:    "both",
+			cmdline: "vsock.token=abc\n",
+			smbios: [][]byte{
+				[]byte("\x0b\x05\x00\x01\x01vsock.token=ghi\x00\x00"),
+				[]byte("\x0b\x05\x00\x01\x01vsock.token=jkl\x00\x00"),
+			},
+			expected: []string{"abc", "ghi", "jkl"},
+		},
+	}
+
+	defer func(cmdline string, smbios string) {
+		bootCmdlinePath = cmdline
+		bootSMBIOSEntries = smbios
+	}(bootCmdlinePath, bootSMBIOSEntries)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "vsock-token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			bootCmdlinePath = filepath.Join(dir, "cmdline")
+			bootSMBIOSEntries = filepath.Join(dir, "11-*", "raw")
+
+			err = ioutil.WriteFile(bootCmdlinePath, []byte(test.cmdline), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, raw := range test.smbios {
+				entry := filepath.Join(dir, fmt.Sprintf("11-%d", i))
+
+				err = os.Mkdir(entry, 0700)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = ioutil.WriteFile(filepath.Join(entry, "raw"), raw, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tokens := bootTokens()
+			if !reflect.DeepEqual(tokens, test.expected) {
+				t.Fatalf("Expected %q, got %q", test.expected, tokens)
+			}
+		})
+	}
+}
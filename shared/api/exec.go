@@ -0,0 +1,41 @@
+package api
+
+// InstanceExecPost represents a command to run in the instance
+type InstanceExecPost struct {
+	Command     []string          `json:"command" yaml:"command"`
+	WaitForWS   bool              `json:"wait-for-websocket" yaml:"wait-for-websocket"`
+	Interactive bool              `json:"interactive" yaml:"interactive"`
+	Environment map[string]string `json:"environment" yaml:"environment"`
+	Width       int               `json:"width" yaml:"width"`
+	Height      int               `json:"height" yaml:"height"`
+
+	// API extension: exec_cwd_user
+	// Unset user and group keep the ones of the agent
+	User  *uint32 `json:"user,omitempty" yaml:"user,omitempty"`
+	Group *uint32 `json:"group,omitempty" yaml:"group,omitempty"`
+	Cwd   string  `json:"cwd" yaml:"cwd"`
+
+	// API extension: exec_limits
+	Limits InstanceExecLimits `json:"limits" yaml:"limits"`
+
+	// API extension: exec_detached
+	Detached bool `json:"detached" yaml:"detached"`
+}
+
+// InstanceExecLimits represents the limits a command is run with. Zero values
+// mean no limit.
+type InstanceExecLimits struct {
+	// Wall-clock time in seconds
+	Timeout int64 `json:"timeout" yaml:"timeout"`
+
+	// Resource limits applied with setrlimit
+	CPUTime      uint64 `json:"cpu_time" yaml:"cpu_time"`
+	Files        uint64 `json:"files" yaml:"files"`
+	AddressSpace uint64 `json:"address_space" yaml:"address_space"`
+	Processes    uint64 `json:"processes" yaml:"processes"`
+
+	// Limits of the transient cgroup the command runs in, memory.max in
+	// bytes and cpu.max as a number of CPUs
+	Memory int64   `json:"memory" yaml:"memory"`
+	CPUs   float64 `json:"cpus" yaml:"cpus"`
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"time"
+)
+
+// InstanceFileEntry represents an entry of a directory listing
+type InstanceFileEntry struct {
+	Name    string    `json:"name" yaml:"name"`
+	Type    string    `json:"type" yaml:"type"`
+	Mode    int       `json:"mode" yaml:"mode"`
+	UID     int64     `json:"uid" yaml:"uid"`
+	GID     int64     `json:"gid" yaml:"gid"`
+	Size    int64     `json:"size" yaml:"size"`
+	ModTime time.Time `json:"mtime" yaml:"mtime"`
+
+	// Target of the entry if it is a symlink
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+}
@@ -17,6 +17,13 @@ type InstanceState struct {
 // InstanceStateDisk represents the disk information section of a LXD container's state
 type InstanceStateDisk struct {
 	Usage int64 `json:"usage" yaml:"usage"`
+
+	Total       int64  `json:"total" yaml:"total"`
+	Free        int64  `json:"free" yaml:"free"`
+	InodesUsage int64  `json:"inodes_usage" yaml:"inodes_usage"`
+	InodesTotal int64  `json:"inodes_total" yaml:"inodes_total"`
+	InodesFree  int64  `json:"inodes_free" yaml:"inodes_free"`
+	Mountpoint  string `json:"mountpoint" yaml:"mountpoint"`
 }
 
 // InstanceStateCPU represents the cpu information section of a LXD container's state
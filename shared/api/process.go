@@ -0,0 +1,18 @@
+package api
+
+// Process represents a process running in the instance
+type Process struct {
+	PID     int64    `json:"pid" yaml:"pid"`
+	PPID    int64    `json:"ppid" yaml:"ppid"`
+	UID     int64    `json:"uid" yaml:"uid"`
+	User    string   `json:"user" yaml:"user"`
+	Name    string   `json:"name" yaml:"name"`
+	Command []string `json:"command" yaml:"command"`
+	State   string   `json:"state" yaml:"state"`
+
+	// Resident set size in bytes
+	RSS int64 `json:"rss" yaml:"rss"`
+
+	// CPU time (user and system) in nanoseconds
+	CPUTime int64 `json:"cpu_time" yaml:"cpu_time"`
+}
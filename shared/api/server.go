@@ -0,0 +1,36 @@
+package api
+
+import (
+	"time"
+)
+
+// Server represents the agent and the guest it runs in
+type Server struct {
+	APIExtensions []string          `json:"api_extensions" yaml:"api_extensions"`
+	APIStatus     string            `json:"api_status" yaml:"api_status"`
+	APIVersion    string            `json:"api_version" yaml:"api_version"`
+	Environment   ServerEnvironment `json:"environment" yaml:"environment"`
+}
+
+// ServerEnvironment represents the read-only environment fields of the agent
+type ServerEnvironment struct {
+	AgentPid     int    `json:"agent_pid" yaml:"agent_pid"`
+	AgentVersion string `json:"agent_version" yaml:"agent_version"`
+
+	Architecture  string    `json:"architecture" yaml:"architecture"`
+	BootTime      time.Time `json:"boot_time" yaml:"boot_time"`
+	Hostname      string    `json:"hostname" yaml:"hostname"`
+	Kernel        string    `json:"kernel" yaml:"kernel"`
+	KernelVersion string    `json:"kernel_version" yaml:"kernel_version"`
+
+	// Fields of /etc/os-release
+	OSName    string            `json:"os_name" yaml:"os_name"`
+	OSVersion string            `json:"os_version" yaml:"os_version"`
+	OSRelease map[string]string `json:"os_release" yaml:"os_release"`
+
+	// Addresses the agent listens on
+	Addresses []string `json:"addresses" yaml:"addresses"`
+
+	VsockCID  uint32 `json:"vsock_cid" yaml:"vsock_cid"`
+	VsockPort uint32 `json:"vsock_port" yaml:"vsock_port"`
+}
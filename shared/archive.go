@@ -0,0 +1,28 @@
+package shared
+
+import (
+	"fmt"
+)
+
+// TarCreateArgs are the tar arguments used to create archives of directory
+// trees, preserving extended attributes, hardlinks and sparse files.
+var TarCreateArgs = []string{"--create", "--file=-", "--numeric-owner", "--xattrs", "--xattrs-include=*", "--sparse"}
+
+// TarExtractArgs are the tar arguments used to extract archives created with
+// TarCreateArgs.
+var TarExtractArgs = []string{"--extract", "--file=-", "--numeric-owner", "--xattrs", "--xattrs-include=*"}
+
+// TarCompressionArgs returns the tar arguments for the given compression
+// algorithm, which is one of none, gzip or zstd.
+func TarCompressionArgs(compression string) ([]string, error) {
+	switch compression {
+	case "", "none":
+		return []string{}, nil
+	case "gzip":
+		return []string{"--gzip"}, nil
+	case "zstd":
+		return []string{"--use-compress-program=zstd"}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression algorithm: %s", compression)
+	}
+}
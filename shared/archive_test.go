@@ -0,0 +1,34 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTarCompressionArgs(t *testing.T) {
+	tests := []struct {
+		compression string
+		args        []string
+		err         bool
+	}{
+		{"", []string{}, false},
+		{"none", []string{}, false},
+		{"gzip", []string{"--gzip"}, false},
+		{"zstd", []string{"--use-compress-program=zstd"}, false},
+		{"bzip2", nil, true},
+		{"GZIP", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.compression, func(t *testing.T) {
+			args, err := TarCompressionArgs(test.compression)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("Expected %v, got %v", test.args, args)
+			}
+		})
+	}
+}
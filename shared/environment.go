@@ -0,0 +1,117 @@
+package shared
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/monstermunchkin/vsock/shared/api"
+)
+
+// RenderEnvironment returns the kernel, OS, hostname, architecture and boot
+// time of the guest. Fields which can't be determined are left empty.
+func RenderEnvironment() api.ServerEnvironment {
+	env := api.ServerEnvironment{}
+
+	uname := unix.Utsname{}
+	err := unix.Uname(&uname)
+	if err != nil {
+		log.Printf("Failed to get kernel information: %v\n", err)
+	} else {
+		env.Kernel = utsnameString(uname.Sysname[:])
+		env.KernelVersion = utsnameString(uname.Release[:])
+		env.Architecture = utsnameString(uname.Machine[:])
+	}
+
+	env.Hostname, err = os.Hostname()
+	if err != nil {
+		log.Printf("Failed to get hostname: %v\n", err)
+	}
+
+	env.OSRelease, err = osRelease()
+	if err != nil {
+		log.Printf("Failed to read OS release: %v\n", err)
+	} else {
+		env.OSName = env.OSRelease["NAME"]
+		env.OSVersion = env.OSRelease["VERSION_ID"]
+	}
+
+	env.BootTime, err = bootTime()
+	if err != nil {
+		log.Printf("Failed to get boot time: %v\n", err)
+	}
+
+	return env
+}
+
+// utsnameString converts a NUL terminated utsname field.
+func utsnameString(field []byte) string {
+	for i, b := range field {
+		if b == 0 {
+			return string(field[:i])
+		}
+	}
+
+	return string(field)
+}
+
+// osRelease parses /etc/os-release, falling back to /usr/lib/os-release.
+func osRelease() (map[string]string, error) {
+	f, err := os.Open("/etc/os-release")
+	if os.IsNotExist(err) {
+		f, err = os.Open("/usr/lib/os-release")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	release := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		value := fields[1]
+		unquoted, err := strconv.Unquote(value)
+		if err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+
+		release[fields[0]] = value
+	}
+
+	return release, scanner.Err()
+}
+
+// bootTime returns the boot time from /proc/stat.
+func bootTime() (time.Time, error) {
+	stat, err := readKeyedInt("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	btime, ok := stat["btime"]
+	if !ok {
+		return time.Time{}, fmt.Errorf("Missing btime in /proc/stat")
+	}
+
+	return time.Unix(btime, 0), nil
+}
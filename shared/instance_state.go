@@ -5,63 +5,395 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/monstermunchkin/vsock/shared/api"
 )
 
+// StateOptions controls what RenderStateWithOptions collects.
+type StateOptions struct {
+	// Include pseudo filesystems such as proc or tmpfs in the disk usage
+	PseudoFilesystems bool
+}
+
 func RenderState() *api.InstanceState {
+	return RenderStateWithOptions(StateOptions{})
+}
+
+func RenderStateWithOptions(options StateOptions) *api.InstanceState {
 	return &api.InstanceState{
 		CPU:       cpuState(),
+		Disk:      diskState(options.PseudoFilesystems),
 		Memory:    memoryState(),
 		Network:   networkState(),
-		PID:       1,
+		PID:       initPID(),
 		Processes: processesState(),
 	}
 }
 
+// cgroupUnified returns whether the unified (cgroup v2) hierarchy is mounted.
+func cgroupUnified() bool {
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	return err == nil
+}
+
+// readInt reads a file containing a single integer.
+func readInt(path string) (int64, error) {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+}
+
+// readInts reads the files in dir containing a single integer and returns
+// their values by file name. Files which can't be read are left out.
+func readInts(dir string, names ...string) map[string]int64 {
+	values := map[string]int64{}
+
+	for _, name := range names {
+		value, err := readInt(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		values[name] = value
+	}
+
+	return values
+}
+
+// readKeyedInt reads a flat keyed file like cpu.stat or /proc/meminfo and
+// returns its integer values.
+func readKeyedInt(path string) (map[string]int64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKeyedInt(string(content)), nil
+}
+
+// parseKeyedInt parses the content of a flat keyed file. Units following the
+// value are ignored.
+func parseKeyedInt(content string) map[string]int64 {
+	values := map[string]int64{}
+
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		values[strings.TrimSuffix(fields[0], ":")] = value
+	}
+
+	return values
+}
+
+// keyedValue returns the value of key, or -1 if it's missing.
+func keyedValue(values map[string]int64, key string) int64 {
+	value, ok := values[key]
+	if !ok {
+		return -1
+	}
+
+	return value
+}
+
 func cpuState() api.InstanceStateCPU {
 	cpu := api.InstanceStateCPU{}
 
-	// CPU usage in seconds
-	value, err := ioutil.ReadFile("/sys/fs/cgroup/cpuacct/cpuacct.usage")
+	// CPU usage in nanoseconds
+	var usage int64
+	var err error
+
+	if cgroupUnified() {
+		var stat map[string]int64
+
+		stat, err = readKeyedInt("/sys/fs/cgroup/cpu.stat")
+		if err == nil {
+			usage, err = cgroupCPUUsage(stat)
+		}
+	} else {
+		usage, err = readInt("/sys/fs/cgroup/cpuacct/cpuacct.usage")
+	}
+
 	if err != nil {
-		cpu.Usage = -1
-		return cpu
+		usage, err = procStatUsage()
 	}
 
-	valueInt, err := strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
 	if err != nil {
 		cpu.Usage = -1
 		return cpu
 	}
 
-	cpu.Usage = valueInt
+	cpu.Usage = usage
 
 	return cpu
 }
 
+// cgroupCPUUsage returns the CPU usage in nanoseconds from the values of a
+// cgroup v2 cpu.stat file, which are in microseconds.
+func cgroupCPUUsage(stat map[string]int64) (int64, error) {
+	value, ok := stat["usage_usec"]
+	if !ok {
+		return -1, fmt.Errorf("Missing usage_usec in cpu.stat")
+	}
+
+	return value * int64(time.Microsecond), nil
+}
+
+// procStatUsage returns the CPU time in nanoseconds spent by the whole system
+// outside of the idle and iowait states, from /proc/stat.
+func procStatUsage() (int64, error) {
+	content, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return -1, err
+	}
+
+	return parseProcStatUsage(string(content))
+}
+
+// parseProcStatUsage returns the busy CPU time in nanoseconds from the
+// content of /proc/stat.
+func parseProcStatUsage(content string) (int64, error) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] != "cpu" {
+			continue
+		}
+
+		// user, nice, system, idle, iowait, irq, softirq and steal, in
+		// USER_HZ units. Guest time is included in user time.
+		var ticks int64
+		for i, field := range fields[1:9] {
+			if i == 3 || i == 4 {
+				continue
+			}
+
+			value, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return -1, err
+			}
+
+			ticks += value
+		}
+
+		return ticks * int64(time.Second/userHZ), nil
+	}
+
+	return -1, fmt.Errorf("Missing cpu line in /proc/stat")
+}
+
 func memoryState() api.InstanceStateMemory {
-	memory := api.InstanceStateMemory{}
+	var memory api.InstanceStateMemory
 
 	// Memory in bytes
-	value, err := ioutil.ReadFile("/sys/fs/cgroup/memory/memory.usage_in_bytes")
-	valueInt, err1 := strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
-	if err == nil && err1 == nil {
-		memory.Usage = valueInt
+	if cgroupUnified() {
+		memory = cgroupV2Memory(readInts("/sys/fs/cgroup", "memory.current", "memory.peak", "memory.swap.current", "memory.swap.peak"))
+	} else {
+		memory = cgroupV1Memory(readInts("/sys/fs/cgroup/memory", "memory.usage_in_bytes", "memory.max_usage_in_bytes", "memory.memsw.usage_in_bytes", "memory.memsw.max_usage_in_bytes"))
+	}
+
+	// The root cgroup doesn't account for memory on cgroup v2, fall back to
+	// the view of the whole VM.
+	if memory.Usage <= 0 {
+		meminfo, err := readKeyedInt("/proc/meminfo")
+		if err != nil {
+			log.Printf("Failed to read memory information: %v\n", err)
+			return memory
+		}
+
+		memory = meminfoMemory(memory, meminfo)
+	}
+
+	return memory
+}
+
+// cgroupV2Memory returns the memory usage from the values of the cgroup v2
+// memory files by name. Missing values are -1.
+func cgroupV2Memory(values map[string]int64) api.InstanceStateMemory {
+	return api.InstanceStateMemory{
+		Usage:         keyedValue(values, "memory.current"),
+		UsagePeak:     keyedValue(values, "memory.peak"),
+		SwapUsage:     keyedValue(values, "memory.swap.current"),
+		SwapUsagePeak: keyedValue(values, "memory.swap.peak"),
+	}
+}
+
+// cgroupV1Memory returns the memory usage from the values of the cgroup v1
+// memory files by name. Missing values are -1.
+func cgroupV1Memory(values map[string]int64) api.InstanceStateMemory {
+	memory := api.InstanceStateMemory{
+		Usage:         keyedValue(values, "memory.usage_in_bytes"),
+		UsagePeak:     keyedValue(values, "memory.max_usage_in_bytes"),
+		SwapUsage:     -1,
+		SwapUsagePeak: -1,
+	}
+
+	// Swap is only accounted for together with memory
+	memsw, ok := values["memory.memsw.usage_in_bytes"]
+	if ok && memory.Usage >= 0 && memsw >= memory.Usage {
+		memory.SwapUsage = memsw - memory.Usage
+	}
+
+	memsw, ok = values["memory.memsw.max_usage_in_bytes"]
+	if ok && memory.UsagePeak >= 0 && memsw >= memory.UsagePeak {
+		memory.SwapUsagePeak = memsw - memory.UsagePeak
 	}
 
-	// Memory peak in bytes
-	value, err = ioutil.ReadFile("/sys/fs/cgroup/memory/memory.max_usage_in_bytes")
-	valueInt, err1 = strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
-	if err == nil && err1 == nil {
-		memory.UsagePeak = valueInt
+	return memory
+}
+
+// meminfoMemory fills in the memory and swap usage of the whole VM from the
+// values of /proc/meminfo, which are in kB.
+func meminfoMemory(memory api.InstanceStateMemory, meminfo map[string]int64) api.InstanceStateMemory {
+	total, okTotal := meminfo["MemTotal"]
+	available, okAvailable := meminfo["MemAvailable"]
+	if okTotal && okAvailable {
+		memory.Usage = (total - available) * 1024
+	}
+
+	if memory.SwapUsage <= 0 {
+		swapTotal, okTotal := meminfo["SwapTotal"]
+		swapFree, okFree := meminfo["SwapFree"]
+		if okTotal && okFree {
+			memory.SwapUsage = (swapTotal - swapFree) * 1024
+		}
 	}
 
 	return memory
 }
 
+// unescapeMountinfo decodes the octal escapes (e.g. \040 for a space) used
+// for paths in /proc/self/mountinfo.
+func unescapeMountinfo(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			value, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			if err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(path[i])
+	}
+
+	return b.String()
+}
+
+// mountinfoEntry is a filesystem mounted at mountpoint, name is its device
+// node for block filesystems and its mount point otherwise.
+type mountinfoEntry struct {
+	name       string
+	mountpoint string
+}
+
+// parseMountinfo returns the first mount of every filesystem in the content of
+// /proc/self/mountinfo. Filesystems not backed by a device node are skipped
+// unless pseudoFilesystems is set.
+func parseMountinfo(content string, pseudoFilesystems bool) []mountinfoEntry {
+	entries := []mountinfoEntry{}
+	devices := map[string]bool{}
+
+	for _, line := range strings.Split(content, "\n") {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+
+		if separator < 0 || separator+2 >= len(fields) {
+			continue
+		}
+
+		device := fields[2]
+		mountpoint := unescapeMountinfo(fields[4])
+		source := unescapeMountinfo(fields[separator+2])
+
+		// Block filesystems are backed by a device node
+		name := mountpoint
+		if strings.HasPrefix(source, "/dev/") {
+			name = strings.TrimPrefix(source, "/dev/")
+		} else if !pseudoFilesystems {
+			continue
+		}
+
+		// Only report the first mount of a filesystem, skipping bind mounts
+		if devices[device] {
+			continue
+		}
+		devices[device] = true
+
+		entries = append(entries, mountinfoEntry{name: name, mountpoint: mountpoint})
+	}
+
+	return entries
+}
+
+// diskUsage returns the usage of the filesystem mounted at mountpoint from
+// its statfs result.
+func diskUsage(stat syscall.Statfs_t, mountpoint string) api.InstanceStateDisk {
+	return api.InstanceStateDisk{
+		Usage:       int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize),
+		Total:       int64(stat.Blocks) * int64(stat.Bsize),
+		Free:        int64(stat.Bavail) * int64(stat.Bsize),
+		InodesUsage: int64(stat.Files - stat.Ffree),
+		InodesTotal: int64(stat.Files),
+		InodesFree:  int64(stat.Ffree),
+		Mountpoint:  mountpoint,
+	}
+}
+
+func diskState(pseudoFilesystems bool) map[string]api.InstanceStateDisk {
+	result := map[string]api.InstanceStateDisk{}
+
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		log.Printf("Failed to read mount information: %v\n", err)
+		return result
+	}
+
+	for _, entry := range parseMountinfo(string(content), pseudoFilesystems) {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(entry.mountpoint, &stat)
+		if err != nil {
+			continue
+		}
+
+		result[entry.name] = diskUsage(stat, entry.mountpoint)
+	}
+
+	return result
+}
+
 func networkState() map[string]api.InstanceStateNetwork {
 	result := map[string]api.InstanceStateNetwork{}
 
@@ -165,27 +497,3 @@ func networkState() map[string]api.InstanceStateNetwork {
 
 	return result
 }
-
-func processesState() int64 {
-	pids := []int64{1}
-
-	// Go through the pid list, adding new pids at the end so we go through them all
-	for i := 0; i < len(pids); i++ {
-		fname := fmt.Sprintf("/proc/%d/task/%d/children", pids[i], pids[i])
-		fcont, err := ioutil.ReadFile(fname)
-		if err != nil {
-			// the process terminated during execution of this loop
-			continue
-		}
-
-		content := strings.Split(string(fcont), " ")
-		for j := 0; j < len(content); j++ {
-			pid, err := strconv.ParseInt(content[j], 10, 64)
-			if err == nil {
-				pids = append(pids, pid)
-			}
-		}
-	}
-
-	return int64(len(pids))
-}
@@ -0,0 +1,390 @@
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/monstermunchkin/vsock/shared/api"
+)
+
+func TestUnescapeMountinfo(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/my\040data`, "/mnt/my data"},
+		{`/mnt/tab\011and\012newline`, "/mnt/tab\tand\nnewline"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`/mnt/end\040`, "/mnt/end "},
+		{`/mnt/short\04`, `/mnt/short\04`},
+		{`/mnt/invalid\089`, `/mnt/invalid\089`},
+		{`/mnt/trailing\`, `/mnt/trailing\`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			result := unescapeMountinfo(test.path)
+			if result != test.expected {
+				t.Fatalf("Expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseMountinfo(t *testing.T) {
+	content := `21 1 252:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+22 21 0:20 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+23 21 0:21 / /tmp rw,nosuid,nodev shared:13 - tmpfs tmpfs rw
+24 21 252:1 /srv /mnt/bind rw,relatime shared:1 - ext4 /dev/vda1 rw
+25 21 252:16 / /mnt/my\040data rw,relatime - xfs /dev/vdb rw
+26 21 0:22 / /sys rw - sysfs sysfs rw
+truncated line
+`
+
+	tests := []struct {
+		name              string
+		pseudoFilesystems bool
+		expected          []mountinfoEntry
+	}{
+		{
+			name: "block filesystems",
+			expected: []mountinfoEntry{
+				{name: "vda1", mountpoint: "/"},
+				{name: "vdb", mountpoint: "/mnt/my data"},
+			},
+		},
+		{
+			name:              "pseudo filesystems",
+			pseudoFilesystems: true,
+			expected: []mountinfoEntry{
+				{name: "vda1", mountpoint: "/"},
+				{name: "/proc", mountpoint: "/proc"},
+				{name: "/tmp", mountpoint: "/tmp"},
+				{name: "vdb", mountpoint: "/mnt/my data"},
+				{name: "/sys", mountpoint: "/sys"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := parseMountinfo(content, test.pseudoFilesystems)
+			if !reflect.DeepEqual(entries, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, entries)
+			}
+		})
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		stat     syscall.Statfs_t
+		expected api.InstanceStateDisk
+	}{
+		{
+			name: "empty",
+			stat: syscall.Statfs_t{Bsize: 4096},
+			expected: api.InstanceStateDisk{
+				Mountpoint: "/",
+			},
+		},
+		{
+			name: "in use",
+			stat: syscall.Statfs_t{
+				Bsize:  4096,
+				Blocks: 1000,
+				Bfree:  400,
+				Bavail: 350,
+				Files:  100,
+				Ffree:  60,
+			},
+			expected: api.InstanceStateDisk{
+				Usage:       600 * 4096,
+				Total:       1000 * 4096,
+				Free:        350 * 4096,
+				InodesUsage: 40,
+				InodesTotal: 100,
+				InodesFree:  60,
+				Mountpoint:  "/",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disk := diskUsage(test.stat, "/")
+			if disk != test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, disk)
+			}
+		})
+	}
+}
+
+func TestParseKeyedInt(t *testing.T) {
+	content := `MemTotal:        2030048 kB
+MemFree:          123456 kB
+usage_usec 1500
+nr_periods abc
+
+invalid
+`
+
+	expected := map[string]int64{
+		"MemTotal":   2030048,
+		"MemFree":    123456,
+		"usage_usec": 1500,
+	}
+
+	values := parseKeyedInt(content)
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %v, got %v", expected, values)
+	}
+}
+
+func TestCgroupCPUUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		stat     map[string]int64
+		expected int64
+		err      bool
+	}{
+		{"microseconds to nanoseconds", map[string]int64{"usage_usec": 1500, "user_usec": 1000}, 1500000, false},
+		{"zero", map[string]int64{"usage_usec": 0}, 0, false},
+		{"missing usage", map[string]int64{"user_usec": 1000}, -1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usage, err := cgroupCPUUsage(test.stat)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if usage != test.expected {
+				t.Fatalf("Expected %d, got %d", test.expected, usage)
+			}
+		})
+	}
+}
+
+func TestParseProcStatUsage(t *testing.T) {
+	tick := int64(time.Second / userHZ)
+
+	tests := []struct {
+		name     string
+		content  string
+		expected int64
+		err      bool
+	}{
+		{
+			name:     "busy time",
+			content:  "cpu  100 20 30 5000 40 5 6 7 0 0\ncpu0 50 10 15 2500 20 2 3 3 0 0\nintr 1234\n",
+			expected: (100 + 20 + 30 + 5 + 6 + 7) * tick,
+		},
+		{
+			name:     "idle",
+			content:  "cpu  0 0 0 5000 40 0 0 0\n",
+			expected: 0,
+		},
+		{
+			name:     "missing cpu line",
+			content:  "cpu0 50 10 15 2500 20 2 3 3\nintr 1234\n",
+			expected: -1,
+			err:      true,
+		},
+		{
+			name:     "truncated cpu line",
+			content:  "cpu  100 20 30\n",
+			expected: -1,
+			err:      true,
+		},
+		{
+			name:     "invalid value",
+			content:  "cpu  100 x 30 5000 40 5 6 7\n",
+			expected: -1,
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usage, err := parseProcStatUsage(test.content)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if usage != test.expected {
+				t.Fatalf("Expected %d, got %d", test.expected, usage)
+			}
+		})
+	}
+}
+
+func TestCgroupV2Memory(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]int64
+		expected api.InstanceStateMemory
+	}{
+		{
+			name: "all files",
+			values: map[string]int64{
+				"memory.current":      1000,
+				"memory.peak":         2000,
+				"memory.swap.current": 300,
+				"memory.swap.peak":    400,
+			},
+			expected: api.InstanceStateMemory{Usage: 1000, UsagePeak: 2000, SwapUsage: 300, SwapUsagePeak: 400},
+		},
+		{
+			name: "missing peak",
+			values: map[string]int64{
+				"memory.current":      1000,
+				"memory.swap.current": 300,
+			},
+			expected: api.InstanceStateMemory{Usage: 1000, UsagePeak: -1, SwapUsage: 300, SwapUsagePeak: -1},
+		},
+		{
+			name: "missing swap",
+			values: map[string]int64{
+				"memory.current": 1000,
+				"memory.peak":    2000,
+			},
+			expected: api.InstanceStateMemory{Usage: 1000, UsagePeak: 2000, SwapUsage: -1, SwapUsagePeak: -1},
+		},
+		{
+			name:     "root cgroup",
+			values:   map[string]int64{},
+			expected: api.InstanceStateMemory{Usage: -1, UsagePeak: -1, SwapUsage: -1, SwapUsagePeak: -1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory := cgroupV2Memory(test.values)
+			if memory != test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, memory)
+			}
+		})
+	}
+}
+
+func TestCgroupV1Memory(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]int64
+		expected api.InstanceStateMemory
+	}{
+		{
+			name: "with swap accounting",
+			values: map[string]int64{
+				"memory.usage_in_bytes":           1000,
+				"memory.max_usage_in_bytes":       2000,
+				"memory.memsw.usage_in_bytes":     1300,
+				"memory.memsw.max_usage_in_bytes": 2400,
+			},
+			expected: api.InstanceStateMemory{Usage: 1000, UsagePeak: 2000, SwapUsage: 300, SwapUsagePeak: 400},
+		},
+		{
+			name: "without swap accounting",
+			values: map[string]int64{
+				"memory.usage_in_bytes":     1000,
+				"memory.max_usage_in_bytes": 2000,
+			},
+			expected: api.InstanceStateMemory{Usage: 1000, UsagePeak: 2000, SwapUsage: -1, SwapUsagePeak: -1},
+		},
+		{
+			name: "missing usage",
+			values: map[string]int64{
+				"memory.memsw.usage_in_bytes": 1300,
+			},
+			expected: api.InstanceStateMemory{Usage: -1, UsagePeak: -1, SwapUsage: -1, SwapUsagePeak: -1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory := cgroupV1Memory(test.values)
+			if memory != test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, memory)
+			}
+		})
+	}
+}
+
+func TestMeminfoMemory(t *testing.T) {
+	meminfo := map[string]int64{
+		"MemTotal":     2000,
+		"MemAvailable": 1500,
+		"SwapTotal":    1000,
+		"SwapFree":     800,
+	}
+
+	tests := []struct {
+		name     string
+		memory   api.InstanceStateMemory
+		meminfo  map[string]int64
+		expected api.InstanceStateMemory
+	}{
+		{
+			name:     "root cgroup",
+			memory:   api.InstanceStateMemory{Usage: -1, UsagePeak: -1, SwapUsage: -1, SwapUsagePeak: -1},
+			meminfo:  meminfo,
+			expected: api.InstanceStateMemory{Usage: 500 * 1024, UsagePeak: -1, SwapUsage: 200 * 1024, SwapUsagePeak: -1},
+		},
+		{
+			name:     "swap from cgroup kept",
+			memory:   api.InstanceStateMemory{Usage: 0, UsagePeak: 100, SwapUsage: 42, SwapUsagePeak: 50},
+			meminfo:  meminfo,
+			expected: api.InstanceStateMemory{Usage: 500 * 1024, UsagePeak: 100, SwapUsage: 42, SwapUsagePeak: 50},
+		},
+		{
+			name:     "incomplete meminfo",
+			memory:   api.InstanceStateMemory{Usage: -1, UsagePeak: -1, SwapUsage: -1, SwapUsagePeak: -1},
+			meminfo:  map[string]int64{"MemTotal": 2000, "SwapFree": 800},
+			expected: api.InstanceStateMemory{Usage: -1, UsagePeak: -1, SwapUsage: -1, SwapUsagePeak: -1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory := meminfoMemory(test.memory, test.meminfo)
+			if memory != test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, memory)
+			}
+		})
+	}
+}
+
+func TestReadInts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsock-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"memory.current": "1000\n",
+		"memory.peak":    "max\n",
+	}
+
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values := readInts(dir, "memory.current", "memory.peak", "memory.swap.current")
+	expected := map[string]int64{"memory.current": 1000}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %v, got %v", expected, values)
+	}
+}
@@ -0,0 +1,257 @@
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monstermunchkin/vsock/shared/api"
+)
+
+// userHZ is the unit of the clock ticks reported in /proc.
+const userHZ = 100
+
+// pfKthread is the PF_KTHREAD process flag marking kernel threads.
+const pfKthread = 0x00200000
+
+type procStat struct {
+	pid     int64
+	ppid    int64
+	name    string
+	state   string
+	flags   uint64
+	cpuTime int64
+	rss     int64
+}
+
+func (s *procStat) kernelThread() bool {
+	return s.flags&pfKthread != 0
+}
+
+// procPids returns the PIDs of all processes in /proc.
+func procPids() ([]int64, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int64{}
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		pids = append(pids, pid)
+	}
+
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+
+	return pids, nil
+}
+
+// readProcStat parses /proc/<pid>/stat.
+func readProcStat(pid int64) (*procStat, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseProcStat(pid, content)
+}
+
+// parseProcStat parses the content of /proc/<pid>/stat.
+func parseProcStat(pid int64, content []byte) (*procStat, error) {
+	var err error
+
+	// The name may contain spaces and parentheses
+	start := bytes.IndexByte(content, '(')
+	end := bytes.LastIndexByte(content, ')')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("Invalid stat file for process %d", pid)
+	}
+
+	// Fields following the name, starting with the state (field 3)
+	fields := strings.Fields(string(content[end+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("Invalid stat file for process %d", pid)
+	}
+
+	stat := &procStat{
+		pid:   pid,
+		name:  string(content[start+1 : end]),
+		state: fields[0],
+	}
+
+	stat.ppid, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	stat.flags, err = strconv.ParseUint(fields[6], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	stat.cpuTime = (utime + stime) * int64(time.Second/userHZ)
+
+	rss, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	stat.rss = rss * int64(os.Getpagesize())
+
+	return stat, nil
+}
+
+// procUID returns the real UID of a process from /proc/<pid>/status.
+func procUID(pid int64) (int64, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return -1, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "Uid:" {
+			continue
+		}
+
+		return strconv.ParseInt(fields[1], 10, 64)
+	}
+
+	return -1, fmt.Errorf("Missing Uid in status file for process %d", pid)
+}
+
+// procCommand returns the command line of a process.
+func procCommand(pid int64) ([]string, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	content = bytes.TrimRight(content, "\x00")
+	if len(content) == 0 {
+		return []string{}, nil
+	}
+
+	return strings.Split(string(content), "\x00"), nil
+}
+
+// initPID returns the PID of the init process, the first process without a
+// parent which isn't a kernel thread.
+func initPID() int64 {
+	pids, err := procPids()
+	if err != nil {
+		return 1
+	}
+
+	for _, pid := range pids {
+		stat, err := readProcStat(pid)
+		if err != nil {
+			continue
+		}
+
+		if stat.ppid == 0 && !stat.kernelThread() {
+			return pid
+		}
+	}
+
+	return 1
+}
+
+// processesState returns the number of processes, not counting kernel
+// threads.
+func processesState() int64 {
+	pids, err := procPids()
+	if err != nil {
+		return -1
+	}
+
+	var count int64
+	for _, pid := range pids {
+		stat, err := readProcStat(pid)
+		if err != nil {
+			// the process terminated in the meantime
+			continue
+		}
+
+		if stat.kernelThread() {
+			continue
+		}
+
+		count++
+	}
+
+	return count
+}
+
+// RenderProcesses returns the process table, including kernel threads.
+func RenderProcesses() []api.Process {
+	processes := []api.Process{}
+	users := map[int64]string{}
+
+	pids, err := procPids()
+	if err != nil {
+		return processes
+	}
+
+	for _, pid := range pids {
+		stat, err := readProcStat(pid)
+		if err != nil {
+			// the process terminated in the meantime
+			continue
+		}
+
+		uid, err := procUID(pid)
+		if err != nil {
+			continue
+		}
+
+		command, err := procCommand(pid)
+		if err != nil {
+			continue
+		}
+
+		username, ok := users[uid]
+		if !ok {
+			u, err := user.LookupId(strconv.FormatInt(uid, 10))
+			if err == nil {
+				username = u.Username
+			}
+
+			users[uid] = username
+		}
+
+		processes = append(processes, api.Process{
+			PID:     stat.pid,
+			PPID:    stat.ppid,
+			UID:     uid,
+			User:    username,
+			Name:    stat.name,
+			Command: command,
+			State:   stat.state,
+			RSS:     stat.rss,
+			CPUTime: stat.cpuTime,
+		})
+	}
+
+	return processes
+}
@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	pageSize := int64(os.Getpagesize())
+
+	tests := []struct {
+		name     string
+		content  string
+		expected *procStat
+	}{
+		{
+			name:    "process",
+			content: "42 (bash) S 1 42 42 34816 42 4194560 1520 0 0 0 150 50 0 0 20 0 1 0 1000 8765440 1200 18446744073709551615 1 1 0 0 0 0 65536 3670020 1266777851 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			expected: &procStat{
+				ppid:    1,
+				name:    "bash",
+				state:   "S",
+				flags:   4194560,
+				cpuTime: 200 * int64(time.Second/userHZ),
+				rss:     1200 * pageSize,
+			},
+		},
+		{
+			name:    "name with spaces and parentheses",
+			content: "42 (my (weird) name) R 7 42 42 0 -1 4194304 0 0 0 0 1 2 0 0 20 0 1 0 1000 0 3 18446744073709551615 1 1 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			expected: &procStat{
+				ppid:    7,
+				name:    "my (weird) name",
+				state:   "R",
+				flags:   4194304,
+				cpuTime: 3 * int64(time.Second/userHZ),
+				rss:     3 * pageSize,
+			},
+		},
+		{
+			name:    "kernel thread",
+			content: "2 (kthreadd) S 0 0 0 0 -1 2129984 0 0 0 0 0 5 0 0 20 0 1 0 2 0 0 18446744073709551615 0 0 0 0 0 0 0 2147483647 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n",
+			expected: &procStat{
+				ppid:    0,
+				name:    "kthreadd",
+				state:   "S",
+				flags:   2129984,
+				cpuTime: 5 * int64(time.Second/userHZ),
+			},
+		},
+		{
+			name:    "missing name",
+			content: "42 bash S 1 42 42 34816 42 4194560 1520 0 0 0 150 50 0 0 20 0 1 0 1000 8765440 1200\n",
+		},
+		{
+			name:    "truncated",
+			content: "42 (bash) S 1 42 42\n",
+		},
+		{
+			name:    "invalid number",
+			content: "42 (bash) S one 42 42 34816 42 4194560 1520 0 0 0 150 50 0 0 20 0 1 0 1000 8765440 1200\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stat, err := parseProcStat(42, []byte(test.content))
+			if test.expected == nil {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", stat)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			test.expected.pid = 42
+			if *stat != *test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, stat)
+			}
+		})
+	}
+}
+
+func TestReadProcStatKernelThread(t *testing.T) {
+	stat, err := readProcStat(int64(os.Getpid()))
+	if err != nil {
+		t.Fatalf("Failed to read own stat file: %v", err)
+	}
+
+	if stat.kernelThread() {
+		t.Fatalf("Test process reported as kernel thread")
+	}
+}
@@ -0,0 +1,26 @@
+package version
+
+// APIVersion contains the API base version. Only bumped for backward incompatible changes.
+var APIVersion = "1.0"
+
+// APIExtensions is the list of all API extensions in the order they were added.
+var APIExtensions = []string{
+	"operations",
+	"events",
+	"exec_cwd_user",
+	"files",
+	"files_directory",
+	"files_archive",
+	"state_cgroup_v2",
+	"state_disk",
+	"processes",
+	"server",
+	"tls",
+	"token_auth",
+	"listen_addresses",
+	"exec_cancel",
+	"exec_limits",
+	"exec_detached",
+	"exec_recording",
+	"metrics",
+}
@@ -0,0 +1,4 @@
+package version
+
+// Version contains the agent version number
+var Version = "0.1"